@@ -0,0 +1,75 @@
+// +build !appengine
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"h12.io/egress/protocol"
+	"h12.io/egress/remote"
+	"h12.io/egress/secret"
+)
+
+func init() {
+	protocol.NewWriter = secret.NewWriter
+	protocol.NewReader = secret.NewReader
+}
+
+func main() {
+	var opt option
+	opt.parse()
+	if opt.Secret == "" {
+		log.Fatal("-secret is required")
+	}
+	if err := secret.LoadKey(opt.Secret); err != nil {
+		log.Fatal(err)
+	}
+	if opt.Auth == "" {
+		log.Fatal("-auth is required")
+	}
+	keys, err := protocol.LoadKeys(opt.Auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	verifier := protocol.NewVerifier(keys, 5*time.Minute)
+	if opt.Policy != "" {
+		if remote.DefaultPolicy, err = remote.LoadPolicy(opt.Policy); err != nil {
+			log.Fatal(err)
+		}
+	}
+	remote.DNSUpstream = opt.DNS
+	if (opt.Cert == "") != (opt.Key == "") {
+		log.Fatal("-cert and -key must be given together")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path.Join("/", opt.Prefix, "f"), remote.Authenticate(verifier, remote.ServeFetch))
+	mux.HandleFunc(path.Join("/", opt.Prefix, "c"), remote.Authenticate(verifier, remote.ServeConnect))
+	mux.HandleFunc(path.Join("/", opt.Prefix, "m"), remote.Authenticate(verifier, remote.ServeMultiplex))
+	mux.HandleFunc(path.Join("/", opt.Prefix, "d"), remote.Authenticate(verifier, remote.ServeDNS))
+	// no read/write timeout because CONNECT tunnels are long lived and the
+	// deadlines would survive hijacking.
+	srv := http.Server{
+		Addr:              opt.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	scheme := "http"
+	if opt.Cert != "" {
+		scheme = "https"
+	}
+	log.Print("Egress remote server started.")
+	log.Printf("        %s://%s%s", scheme, opt.Addr, path.Join("/", opt.Prefix))
+	if opt.Cert != "" {
+		err = srv.ListenAndServeTLS(opt.Cert, opt.Key)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil {
+		log.Print(err)
+	}
+}
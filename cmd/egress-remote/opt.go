@@ -0,0 +1,38 @@
+// +build !appengine
+
+package main
+
+import (
+	"flag"
+	"os"
+
+	"h12.io/egress/remote"
+)
+
+type option struct {
+	Addr   string
+	Cert   string
+	Key    string
+	Prefix string
+	Secret string
+	Auth   string
+	Policy string
+	DNS    string
+}
+
+func (self *option) parse() {
+	flag.StringVar(&self.Addr, "addr", "0.0.0.0:8080", "listening address")
+	flag.StringVar(&self.Cert, "cert", "", "TLS certificate file, serving plain HTTP if empty")
+	flag.StringVar(&self.Key, "key", "", "TLS private key file")
+	flag.StringVar(&self.Prefix, "prefix", "/", "path prefix, same as the path of the local -remote URL")
+	flag.StringVar(&self.Secret, "secret", "", "file containing the 32-byte key in hex shared with the local egress, e.g. generated by \"openssl rand -hex 32\"")
+	flag.StringVar(&self.Auth, "auth", "", "file containing the client authentication keys")
+	flag.StringVar(&self.Policy, "policy", "", "destination policy file, denying private networks if empty")
+	flag.StringVar(&self.DNS, "dns", remote.DNSUpstream, "DNS-over-HTTPS resolver for the local egress")
+	flag.Parse()
+	self.Cert = os.ExpandEnv(self.Cert)
+	self.Key = os.ExpandEnv(self.Key)
+	self.Secret = os.ExpandEnv(self.Secret)
+	self.Auth = os.ExpandEnv(self.Auth)
+	self.Policy = os.ExpandEnv(self.Policy)
+}
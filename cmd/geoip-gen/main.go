@@ -0,0 +1,121 @@
+// Command geoip-gen generates the IP range tables of countries for package
+// geoip from the GeoLite2 Country database, and embedded.go that compiles the
+// countries of the same run into geoip.Embedded. Run it with go generate in
+// the geoip directory after putting the database files into geoip/data.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"net"
+	"path"
+	"strings"
+
+	"h12.io/egress/geoip"
+)
+
+func main() {
+	var opt option
+	opt.parse()
+	if len(opt.Countries) == 0 {
+		log.Fatal("no country is given")
+	}
+	db, err := geoip.Load(opt.Dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if db == geoip.Embedded {
+		log.Fatalf("no GeoLite2 Country database in %s", opt.Dir)
+	}
+	for _, c := range opt.Countries {
+		ranges := db.Country(c.Code)
+		if len(ranges.V4) == 0 && len(ranges.V6) == 0 {
+			log.Fatalf("country %s not found", c.Code)
+		}
+		if err := ranges.V4.Validate(); err != nil {
+			log.Fatalf("%s IPv4: %v", c.Code, err)
+		}
+		if err := ranges.V6.Validate(); err != nil {
+			log.Fatalf("%s IPv6: %v", c.Code, err)
+		}
+		file := path.Join(opt.Out, strings.ToLower(c.Name))
+		if err := write(file+".go", genV4(opt.Package, c, ranges.V4)); err != nil {
+			log.Fatal(err)
+		}
+		if err := write(file+"6.go", genV6(opt.Package, c, ranges.V6)); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%s: %d IPv4 ranges, %d IPv6 ranges", c.Code, len(ranges.V4), len(ranges.V6))
+	}
+	if err := write(path.Join(opt.Out, "embedded.go"), genEmbedded(opt.Package, opt.Countries)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func genEmbedded(pkg string, countries []country) []byte {
+	var buf bytes.Buffer
+	header(&buf, pkg)
+	fmt.Fprintln(&buf, "// embeddedCountries are the countries compiled into Embedded by ISO code.")
+	fmt.Fprintln(&buf, "var embeddedCountries = map[string]*Country{")
+	for _, c := range countries {
+		fmt.Fprintf(&buf, "%q: {%sList, %sListV6},\n", c.Code, c.Name, c.Name)
+	}
+	fmt.Fprintln(&buf, "}")
+	return buf.Bytes()
+}
+
+func genV4(pkg string, c country, list geoip.IPNetListV4) []byte {
+	var buf bytes.Buffer
+	header(&buf, pkg)
+	fmt.Fprintf(&buf, "// %sList holds the IPv4 ranges of %s.\n", c.Name, c.Code)
+	fmt.Fprintf(&buf, "var %sList = IPNetListV4{\n", c.Name)
+	for _, n := range list {
+		fmt.Fprintf(&buf, "{%d, %d}, // %15s - %s\n", n.Lo, n.Hi, numToIP4(n.Lo), numToIP4(n.Hi))
+	}
+	fmt.Fprintln(&buf, "}")
+	return buf.Bytes()
+}
+
+func genV6(pkg string, c country, list geoip.IPNetListV6) []byte {
+	var buf bytes.Buffer
+	header(&buf, pkg)
+	fmt.Fprintf(&buf, "// %sListV6 holds the IPv6 ranges of %s.\n", c.Name, c.Code)
+	fmt.Fprintf(&buf, "var %sListV6 = IPNetListV6{\n", c.Name)
+	for _, n := range list {
+		fmt.Fprintf(&buf, "{IPv6{%#x, %#x}, IPv6{%#x, %#x}}, // %s - %s\n",
+			n.Lo[0], n.Lo[1], n.Hi[0], n.Hi[1], numToIP6(n.Lo), numToIP6(n.Hi))
+	}
+	fmt.Fprintln(&buf, "}")
+	return buf.Bytes()
+}
+
+func header(buf *bytes.Buffer, pkg string) {
+	fmt.Fprintln(buf, "// Code generated by geoip-gen from the GeoLite2 Country database; DO NOT EDIT.")
+	fmt.Fprintln(buf)
+	fmt.Fprintf(buf, "package %s\n\n", pkg)
+}
+
+func write(file string, src []byte) error {
+	src, err := format.Source(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, src, 0644)
+}
+
+func numToIP4(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+func numToIP6(n geoip.IPv6) net.IP {
+	ip := make(net.IP, 16)
+	binary.BigEndian.PutUint64(ip, n[0])
+	binary.BigEndian.PutUint64(ip[8:], n[1])
+	return ip
+}
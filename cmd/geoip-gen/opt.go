@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type option struct {
+	Dir       string
+	Out       string
+	Package   string
+	Countries []country
+}
+
+// country is an ISO country code with the name used in the variable and
+// file names.
+type country struct {
+	Code string
+	Name string
+}
+
+func (self *option) parse() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: geoip-gen [flags] <code>[=<name>]...")
+		fmt.Fprintln(os.Stderr, "generates <name>List and <name>ListV6 in <name>.go and <name>6.go for each ISO country code,")
+		fmt.Fprintln(os.Stderr, "and embedded.go compiling all of them into geoip.Embedded")
+		flag.PrintDefaults()
+	}
+	flag.StringVar(&self.Dir, "dir", "data", "directory of the GeoLite2 Country database in MMDB or CSV format")
+	flag.StringVar(&self.Out, "out", ".", "output directory")
+	flag.StringVar(&self.Package, "pkg", "geoip", "package name of the generated files")
+	flag.Parse()
+	for _, arg := range flag.Args() {
+		c := country{Code: strings.ToUpper(arg), Name: strings.ToUpper(arg)}
+		if i := strings.Index(arg, "="); i >= 0 {
+			c.Code, c.Name = strings.ToUpper(arg[:i]), arg[i+1:]
+		}
+		self.Countries = append(self.Countries, c)
+	}
+}
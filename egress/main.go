@@ -2,10 +2,11 @@ package main
 
 import (
 	"log"
+	"net"
 	"net/http"
-	"net/url"
 	"time"
 
+	"h12.io/egress/geoip"
 	"h12.io/egress/local"
 	"h12.io/egress/protocol"
 	"h12.io/egress/secret"
@@ -19,22 +20,48 @@ func init() {
 func main() {
 	var opt option
 	opt.parse()
-	remote, err := url.Parse(opt.Remote)
+	cfg, setKey, err := opt.load()
 	if err != nil {
 		log.Fatal(err)
 	}
-	egress, err := local.NewEgress(remote, opt.Dir, opt.Fetch, opt.Connect)
+	setKey()
+	if err := cfg.SetupLog(); err != nil {
+		log.Fatal(err)
+	}
+	if err := geoip.Reload(cfg.Dir); err != nil {
+		log.Printf("fail to load GeoIP database, using the embedded one: %s", err.Error())
+	}
+	egress, err := local.NewEgress(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	egress.ProbeBlockList(cfg.Route.BlockTTL, cfg.Route.Probes)
+	egress.Watch(10*time.Second, opt.load)
+	if cfg.Listen.SOCKS != "" {
+		ln, err := net.Listen("tcp", cfg.Listen.SOCKS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		user, password := cfg.Listen.SOCKSUser()
+		log.Printf("        socks5://%s   ->   %s", cfg.Listen.SOCKS, cfg.Remote.URL)
+		go func() {
+			log.Print(egress.ServeSOCKS(ln, user, password))
+		}()
+	}
+	if cfg.Listen.DNS != "" {
+		log.Printf("        dns://%s", cfg.Listen.DNS)
+		go func() {
+			log.Print(egress.ServeDNS(cfg.Listen.DNS, cfg.Listen.DNSUpstream))
+		}()
+	}
 	srv := http.Server{
-		Addr:         "0.0.0.0:" + opt.Port,
+		Addr:         cfg.Listen.HTTP,
 		Handler:      egress,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		ReadTimeout:  cfg.Timeout.Read,
+		WriteTimeout: cfg.Timeout.Write,
 	}
 	log.Print("Egress local server started.")
-	log.Printf("        http://0.0.0.0:%s   ->   %s", opt.Port, opt.Remote)
+	log.Printf("        http://%s   ->   %s", cfg.Listen.HTTP, cfg.Remote.URL)
 	if err := srv.ListenAndServe(); err != nil {
 		log.Print(err)
 	}
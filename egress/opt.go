@@ -2,8 +2,13 @@ package main
 
 import (
 	"flag"
+	"net"
 	"os"
 	"path"
+	"time"
+
+	"h12.io/egress/local"
+	"h12.io/egress/secret"
 )
 
 type option struct {
@@ -12,14 +17,93 @@ type option struct {
 	Dir     string
 	Fetch   string
 	Connect string
+	Socks   string
+	User    string
+	Mux     int
+	TTL     time.Duration
+	Probes  int
+	Race    time.Duration
+	DNS     string
+	Resolv  string
+}
+
+// flagKeys maps the flags to the keys of the configuration they override.
+var flagKeys = map[string]string{
+	"port":         "listen.http",
+	"remote":       "remote.url",
+	"fetch":        "route.fetch",
+	"connect":      "route.connect",
+	"socks":        "listen.socks",
+	"socks-auth":   "listen.socks_auth",
+	"mux":          "remote.mux",
+	"block-ttl":    "route.block_ttl",
+	"probes":       "route.probes",
+	"race":         "route.race",
+	"dns":          "listen.dns",
+	"dns-upstream": "listen.dns_upstream",
+}
+
+// portHosts are the hosts to listen on for the flags of a port. The SOCKS5
+// proxy and the DNS server only listen on the loopback interface, so that
+// they are not open to the network without authentication.
+var portHosts = map[string]string{
+	"port":  "0.0.0.0",
+	"socks": "127.0.0.1",
+	"dns":   "127.0.0.1",
 }
 
 func (self *option) parse() {
 	flag.StringVar(&self.Port, "port", "1984", "listening on http://localhost:<port>")
 	flag.StringVar(&self.Remote, "remote", "http://127.0.0.1:8080", "remote address")
-	flag.StringVar(&self.Dir, "dir", path.Join("$HOME", ".egress"), "directory for configuration file")
+	flag.StringVar(&self.Dir, "dir", path.Join("$HOME", ".egress"), "directory for configuration file "+local.ConfigFile)
 	flag.StringVar(&self.Fetch, "fetch", "smart", "fetcher: smart, remote and direct.")
 	flag.StringVar(&self.Connect, "connect", "smart", "connector: smart, direct, remote or faketls.")
+	flag.StringVar(&self.Socks, "socks", "", "SOCKS5 listening on localhost:<socks>, disabled if empty")
+	flag.StringVar(&self.User, "socks-auth", "", "SOCKS5 username and password as <user>:<password>, no auth if empty")
+	flag.IntVar(&self.Mux, "mux", 1, "number of multiplexed connections to the remote for CONNECT, 0 for one connection per tunnel")
+	flag.DurationVar(&self.TTL, "block-ttl", 7*24*time.Hour, "re-probe blocked sites directly after <block-ttl>, 0 to disable")
+	flag.IntVar(&self.Probes, "probes", 4, "max number of concurrent probes")
+	flag.DurationVar(&self.Race, "race", 0, "in smart mode, also connect through the remote if the direct connection is not ready after <race>, 0 to disable")
+	flag.StringVar(&self.DNS, "dns", "", "DNS server listening on localhost:<dns> over UDP and TCP, disabled if empty")
+	flag.StringVar(&self.Resolv, "dns-upstream", "", "upstream DNS server <host>:<port> for direct domains, the system resolver if empty")
 	flag.Parse()
 	self.Dir = os.ExpandEnv(self.Dir)
 }
+
+// config loads the configuration file in the directory, overridden by the
+// flags given on the command line.
+func (self *option) config() (*local.Config, error) {
+	cfg, err := local.LoadConfig(self.Dir)
+	if err != nil {
+		return nil, err
+	}
+	flag.Visit(func(f *flag.Flag) {
+		key, ok := flagKeys[f.Name]
+		if !ok || err != nil {
+			return
+		}
+		value := f.Value.String()
+		if host, ok := portHosts[f.Name]; ok && value != "" {
+			value = net.JoinHostPort(host, value)
+		}
+		err = cfg.Set(key, value, "flag -"+f.Name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// load returns the configuration, and the function to set the secret shared
+// with the remote, which is read but not set yet.
+func (self *option) load() (*local.Config, func(), error) {
+	cfg, err := self.config()
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := secret.ReadKey(cfg.Path(cfg.Remote.Secret))
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, func() { secret.SetKey(key) }, nil
+}
@@ -0,0 +1,15 @@
+package geoip
+
+// ChinaListV6 holds a few major IPv6 allocations in China, picked by hand and
+// far from complete, until it is regenerated by go generate from the GeoLite2
+// IPv6 blocks, which are not in data.
+var ChinaListV6 = IPNetListV6{
+	{IPv6{0x2001025000000000, 0x0}, IPv6{0x20010253ffffffff, 0xffffffffffffffff}}, // 2001:250:: - 2001:253:ffff:ffff:ffff:ffff:ffff:ffff
+	{IPv6{0x20010da800000000, 0x0}, IPv6{0x20010da8ffffffff, 0xffffffffffffffff}}, // 2001:da8:: - 2001:da8:ffff:ffff:ffff:ffff:ffff:ffff
+	{IPv6{0x2400320000000000, 0x0}, IPv6{0x24003200ffffffff, 0xffffffffffffffff}}, // 2400:3200:: - 2400:3200:ffff:ffff:ffff:ffff:ffff:ffff
+	{IPv6{0x2400da0000000000, 0x0}, IPv6{0x2400da00ffffffff, 0xffffffffffffffff}}, // 2400:da00:: - 2400:da00:ffff:ffff:ffff:ffff:ffff:ffff
+	{IPv6{0x24024e0000000000, 0x0}, IPv6{0x24024e00ffffffff, 0xffffffffffffffff}}, // 2402:4e00:: - 2402:4e00:ffff:ffff:ffff:ffff:ffff:ffff
+	{IPv6{0x2408800000000000, 0x0}, IPv6{0x24088fffffffffff, 0xffffffffffffffff}}, // 2408:8000:: - 2408:8fff:ffff:ffff:ffff:ffff:ffff:ffff
+	{IPv6{0x2409800000000000, 0x0}, IPv6{0x24098fffffffffff, 0xffffffffffffffff}}, // 2409:8000:: - 2409:8fff:ffff:ffff:ffff:ffff:ffff:ffff
+	{IPv6{0x240e000000000000, 0x0}, IPv6{0x240e0fffffffffff, 0xffffffffffffffff}}, // 240e:: - 240e:fff:ffff:ffff:ffff:ffff:ffff:ffff
+}
@@ -43,3 +43,31 @@ func TestSearch(t *testing.T) {
 		}
 	}
 }
+
+func TestSearchV6(t *testing.T) {
+	for i, b := range []bool{
+		!geoip.ChinaListV6.Contains(net.ParseIP("::")),
+		!geoip.ChinaListV6.Contains(net.ParseIP("2001:24f:ffff::")),
+
+		geoip.ChinaListV6.Contains(net.ParseIP("2001:250::")),
+		geoip.ChinaListV6.Contains(net.ParseIP("2001:253:ffff:ffff:ffff:ffff:ffff:ffff")),
+		!geoip.ChinaListV6.Contains(net.ParseIP("2001:254::")),
+
+		geoip.ChinaListV6.Contains(net.ParseIP("240e:fff:ffff:ffff:ffff:ffff:ffff:ffff")),
+		!geoip.ChinaListV6.Contains(net.ParseIP("240e:1000::")),
+		!geoip.ChinaListV6.Contains(net.ParseIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")),
+
+		// AliDNS
+		geoip.ChinaListV6.Contains(net.ParseIP("2400:3200::1")),
+
+		// Google DNS
+		!geoip.ChinaListV6.Contains(net.ParseIP("2001:4860:4860::8888")),
+
+		// IPv4 addresses are not in the list
+		!geoip.ChinaListV6.Contains(net.IP{1, 0, 1, 0}),
+	} {
+		if !b {
+			t.Fatalf("test case %d failed.", i)
+		}
+	}
+}
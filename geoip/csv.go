@@ -0,0 +1,105 @@
+package geoip
+
+import (
+	"encoding/csv"
+	"io"
+	"net"
+	"os"
+
+	"h12.io/errors"
+)
+
+// LoadCSV loads the GeoLite2 Country database in CSV format. The IPv6 blocks
+// file is optional.
+func LoadCSV(locationsFile, blocksV4File, blocksV6File string) (*DB, error) {
+	countries, err := readLocations(locationsFile)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{}
+	if err := readBlocks(db, blocksV4File, countries); err != nil {
+		return nil, err
+	}
+	if exists(blocksV6File) {
+		if err := readBlocks(db, blocksV6File, countries); err != nil {
+			return nil, err
+		}
+	}
+	db.finish()
+	return db, nil
+}
+
+// readLocations returns the ISO country codes by geoname ID.
+func readLocations(file string) (map[string]string, error) {
+	m := make(map[string]string)
+	err := readCSV(file, func(record []string) error {
+		if len(record) < 5 {
+			return errors.Format("%s: too few columns: %v", file, record)
+		}
+		if record[4] != "" {
+			m[record[0]] = record[4]
+		}
+		return nil
+	})
+	return m, err
+}
+
+func readBlocks(db *DB, file string, countries map[string]string) error {
+	return readCSV(file, func(record []string) error {
+		if len(record) < 3 {
+			return errors.Format("%s: too few columns: %v", file, record)
+		}
+		_, ipNet, err := net.ParseCIDR(record[0])
+		if err != nil {
+			return errors.Format("%s: %v", file, err)
+		}
+		country := countries[record[1]]
+		if country == "" {
+			country = countries[record[2]] // registered country
+		}
+		if country == "" {
+			return nil
+		}
+		lo, hi := ipNet.IP, lastIP(ipNet)
+		if lo4 := lo.To4(); lo4 != nil {
+			db.addV4(ip4ToNum(lo4), ip4ToNum(hi.To4()), country)
+		} else {
+			db.addV6(ip6ToNum(lo), ip6ToNum(hi), country)
+		}
+		return nil
+	})
+}
+
+func lastIP(n *net.IPNet) net.IP {
+	ip := make(net.IP, len(n.IP))
+	for i := range ip {
+		ip[i] = n.IP[i] | ^n.Mask[i]
+	}
+	return ip
+}
+
+// readCSV calls fn with each record after the header line.
+func readCSV(file string, fn func(record []string) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	if _, err := r.Read(); err != nil { // column names
+		return errors.Wrap(err)
+	}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
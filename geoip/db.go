@@ -0,0 +1,282 @@
+package geoip
+
+import (
+	"log"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Files of the GeoLite2 Country database looked for in the directory passed
+// to Load. The MMDB file is preferred over the CSV files.
+const (
+	MMDBFile      = "GeoLite2-Country.mmdb"
+	LocationsFile = "GeoLite2-Country-Locations-en.csv"
+	BlocksV4File  = "GeoLite2-Country-Blocks-IPv4.csv"
+	BlocksV6File  = "GeoLite2-Country-Blocks-IPv6.csv"
+)
+
+type (
+	// DB maps IP ranges to ISO country codes.
+	DB struct {
+		v4        []countryNetV4
+		v6        []countryNetV6
+		countries map[string]*Country
+	}
+	// Country holds the IP ranges of a country.
+	Country struct {
+		V4 IPNetListV4
+		V6 IPNetListV6
+	}
+	countryNetV4 struct {
+		IPNetV4
+		country string
+	}
+	countryNetV6 struct {
+		IPNetV6
+		country string
+	}
+)
+
+// Embedded is the DB compiled in, which has the countries in
+// embeddedCountries generated by geoip-gen, China by default.
+var Embedded = newEmbedded()
+
+func newEmbedded() *DB {
+	db := &DB{}
+	for code, c := range embeddedCountries {
+		for _, n := range c.V4 {
+			db.addV4(n.Lo, n.Hi, code)
+		}
+		for _, n := range c.V6 {
+			db.addV6(n.Lo, n.Hi, code)
+		}
+	}
+	db.finish()
+	return db
+}
+
+// Contains returns true if ip is in the country. A nil Country contains
+// nothing.
+func (c *Country) Contains(ip net.IP) bool {
+	if c == nil {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return c.V4.Contains(ip4)
+	}
+	return c.V6.Contains(ip.To16())
+}
+
+// Country returns the IP ranges of the country with the ISO code, which are
+// empty if the country is not in the DB.
+func (db *DB) Country(code string) *Country {
+	if c := db.countries[code]; c != nil {
+		return c
+	}
+	return &Country{}
+}
+
+// Countries returns the ISO codes of the countries in the DB.
+func (db *DB) Countries() []string {
+	codes := make([]string, 0, len(db.countries))
+	for code := range db.countries {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// Lookup returns the ISO country code of ip, or an empty string if unknown.
+func (db *DB) Lookup(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		n := ip4ToNum(ip4)
+		i := sort.Search(len(db.v4), func(i int) bool { return db.v4[i].Hi >= n })
+		if i < len(db.v4) && db.v4[i].Lo <= n {
+			return db.v4[i].country
+		}
+		return ""
+	}
+	if ip = ip.To16(); ip == nil {
+		return ""
+	}
+	n := ip6ToNum(ip)
+	i := sort.Search(len(db.v6), func(i int) bool { return !db.v6[i].Hi.less(n) })
+	if i < len(db.v6) && !n.less(db.v6[i].Lo) {
+		return db.v6[i].country
+	}
+	return ""
+}
+
+func (db *DB) addV4(lo, hi uint32, country string) {
+	db.v4 = append(db.v4, countryNetV4{IPNetV4{lo, hi}, country})
+}
+
+func (db *DB) addV6(lo, hi IPv6, country string) {
+	db.v6 = append(db.v6, countryNetV6{IPNetV6{lo, hi}, country})
+}
+
+// finish sorts the ranges, merges adjacent or overlapping ranges of the same
+// country and builds the ranges of each country.
+func (db *DB) finish() {
+	sort.Slice(db.v4, func(i, j int) bool { return db.v4[i].Lo < db.v4[j].Lo })
+	sort.Slice(db.v6, func(i, j int) bool { return db.v6[i].Lo.less(db.v6[j].Lo) })
+	v4 := db.v4[:0]
+	for _, n := range db.v4 {
+		if last := len(v4) - 1; last >= 0 && v4[last].country == n.country &&
+			(n.Lo <= v4[last].Hi || n.Lo == v4[last].Hi+1) {
+			if n.Hi > v4[last].Hi {
+				v4[last].Hi = n.Hi
+			}
+			continue
+		}
+		v4 = append(v4, n)
+	}
+	db.v4 = v4
+	v6 := db.v6[:0]
+	for _, n := range db.v6 {
+		if last := len(v6) - 1; last >= 0 && v6[last].country == n.country &&
+			(!v6[last].Hi.less(n.Lo) || v6[last].Hi.next() == n.Lo) {
+			if v6[last].Hi.less(n.Hi) {
+				v6[last].Hi = n.Hi
+			}
+			continue
+		}
+		v6 = append(v6, n)
+	}
+	db.v6 = v6
+
+	db.countries = make(map[string]*Country)
+	country := func(code string) *Country {
+		c := db.countries[code]
+		if c == nil {
+			c = &Country{}
+			db.countries[code] = c
+		}
+		return c
+	}
+	for _, n := range db.v4 {
+		c := country(n.country)
+		c.V4 = append(c.V4, n.IPNetV4)
+	}
+	for _, n := range db.v6 {
+		c := country(n.country)
+		c.V6 = append(c.V6, n.IPNetV6)
+	}
+}
+
+func (a IPv6) next() IPv6 {
+	if a[1] == ^uint64(0) {
+		return IPv6{a[0] + 1, 0}
+	}
+	return IPv6{a[0], a[1] + 1}
+}
+
+// Load loads the GeoLite2 Country database in dir, from the MMDB file if it
+// exists, or else from the CSV files. Embedded is returned if there is none.
+func Load(dir string) (*DB, error) {
+	if exists(path.Join(dir, MMDBFile)) {
+		return LoadMMDB(path.Join(dir, MMDBFile))
+	}
+	if exists(path.Join(dir, LocationsFile)) {
+		return LoadCSV(path.Join(dir, LocationsFile), path.Join(dir, BlocksV4File), path.Join(dir, BlocksV6File))
+	}
+	return Embedded, nil
+}
+
+func exists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+var (
+	defaultDB atomic.Value
+
+	loadMu     sync.Mutex
+	loadedMods map[string]time.Time
+)
+
+func init() {
+	defaultDB.Store(Embedded)
+}
+
+// Default returns the DB set by SetDefault or loaded by Reload, or Embedded.
+func Default() *DB {
+	return defaultDB.Load().(*DB)
+}
+
+// SetDefault replaces the DB returned by Default.
+func SetDefault(db *DB) {
+	defaultDB.Store(db)
+}
+
+// Reload loads the database in dir as the default if any of its files has
+// changed since the last reload. The default is kept if the load fails.
+func Reload(dir string) error {
+	commit, err := Prepare(dir)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// Prepare loads the database in dir if any of its files has changed since the
+// last reload, and returns the function to make it the default, which does
+// nothing if unchanged. Nothing is changed until it is called.
+func Prepare(dir string) (commit func(), err error) {
+	loadMu.Lock()
+	mods := modTimes(dir)
+	unchanged := loadedMods != nil && sameModTimes(mods, loadedMods)
+	loadMu.Unlock()
+	if unchanged {
+		return func() {}, nil
+	}
+	db, err := Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		loadMu.Lock()
+		defer loadMu.Unlock()
+		SetDefault(db)
+		loadedMods = mods
+		log.Printf("GeoIP database loaded from %s: %d countries", dir, len(db.countries))
+	}, nil
+}
+
+// Files returns the files in dir that the database is loaded from.
+func Files(dir string) []string {
+	return []string{
+		path.Join(dir, MMDBFile),
+		path.Join(dir, LocationsFile),
+		path.Join(dir, BlocksV4File),
+		path.Join(dir, BlocksV6File),
+	}
+}
+
+func modTimes(dir string) map[string]time.Time {
+	mods := make(map[string]time.Time)
+	for _, file := range Files(dir) {
+		if fi, err := os.Stat(file); err == nil {
+			mods[file] = fi.ModTime()
+		}
+	}
+	return mods
+}
+
+func sameModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for file, t := range a {
+		if !b[file].Equal(t) {
+			return false
+		}
+	}
+	return true
+}
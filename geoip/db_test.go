@@ -0,0 +1,249 @@
+package geoip_test
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"h12.io/egress/geoip"
+)
+
+func TestLoadCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, geoip.LocationsFile), []byte(
+		"geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name\n"+
+			"1814991,en,AS,Asia,CN,China\n"+
+			"6252001,en,NA,\"North America\",US,\"United States\"\n"), 0600)
+	ioutil.WriteFile(path.Join(dir, geoip.BlocksV4File), []byte(
+		"network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider\n"+
+			"1.0.1.0/24,1814991,1814991,,0,0\n"+
+			"1.0.2.0/23,1814991,1814991,,0,0\n"+
+			"8.8.8.0/24,,6252001,,0,0\n"), 0600)
+	ioutil.WriteFile(path.Join(dir, geoip.BlocksV6File), []byte(
+		"network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider\n"+
+			"240e::/20,1814991,1814991,,0,0\n"), 0600)
+
+	db, err := geoip.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB(t, db, map[string]string{
+		"1.0.0.255": "",
+		"1.0.1.0":   "CN",
+		"1.0.3.255": "CN",
+		"1.0.4.0":   "",
+		"8.8.8.8":   "US",
+		"240e::1":   "CN",
+		"2400::1":   "",
+	})
+	if cn := db.Country("CN"); len(cn.V4) != 1 || len(cn.V6) != 1 {
+		t.Fatalf("expect adjacent ranges merged, got %v", cn)
+	}
+}
+
+func TestLoadMMDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, geoip.MMDBFile), testMMDB(), 0600)
+
+	db, err := geoip.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB(t, db, map[string]string{
+		"0.255.255.255": "",
+		"1.2.3.4":       "CN",
+		"2.255.255.255": "CN",
+		"8.8.8.8":       "US",
+		"9.0.0.1":       "",
+		"240e::1":       "CN",
+		"240e:1000::":   "",
+	})
+	if cn := db.Country("CN"); len(cn.V4) != 1 || len(cn.V6) != 1 {
+		t.Fatalf("expect merged ranges without aliases, got %v", cn)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer geoip.SetDefault(geoip.Embedded)
+
+	if err := geoip.Reload(dir); err != nil {
+		t.Fatal(err)
+	}
+	if geoip.Default() != geoip.Embedded {
+		t.Fatal("expect the embedded DB without files")
+	}
+	file := path.Join(dir, geoip.MMDBFile)
+	ioutil.WriteFile(file, testMMDB(), 0600)
+	if err := geoip.Reload(dir); err != nil {
+		t.Fatal(err)
+	}
+	if geoip.Default().Lookup(net.ParseIP("8.8.8.8")) != "US" {
+		t.Fatal("expect the MMDB file loaded")
+	}
+	loaded := geoip.Default()
+	if err := geoip.Reload(dir); err != nil || geoip.Default() != loaded {
+		t.Fatal("expect no reload without changes")
+	}
+	ioutil.WriteFile(file, testMMDB(), 0600)
+	os.Chtimes(file, time.Now(), time.Now().Add(time.Hour))
+	commit, err := geoip.Prepare(dir)
+	if err != nil || geoip.Default() != loaded {
+		t.Fatal("expect the DB not replaced before commit")
+	}
+	commit()
+	if geoip.Default() == loaded {
+		t.Fatal("expect the DB replaced on commit")
+	}
+	loaded = geoip.Default()
+	if err := geoip.Reload(dir); err != nil || geoip.Default() != loaded {
+		t.Fatal("expect no reload without changes")
+	}
+	ioutil.WriteFile(file, []byte("broken"), 0600)
+	os.Chtimes(file, time.Now(), time.Now().Add(time.Minute))
+	if err := geoip.Reload(dir); err == nil || geoip.Default() != loaded {
+		t.Fatal("expect the loaded DB kept on error")
+	}
+}
+
+func TestEmbedded(t *testing.T) {
+	if !geoip.Embedded.Country("CN").Contains(net.IP{123, 125, 114, 144}) ||
+		geoip.Embedded.Lookup(net.ParseIP("2400:3200::1")) != "CN" ||
+		geoip.Embedded.Country("US").Contains(net.IP{8, 8, 8, 8}) {
+		t.Fatal("wrong embedded DB")
+	}
+}
+
+func testDB(t *testing.T, db *geoip.DB, expected map[string]string) {
+	for ip, country := range expected {
+		if actual := db.Lookup(net.ParseIP(ip)); actual != country {
+			t.Fatalf("%s: expect %q, got %q", ip, country, actual)
+		}
+		if country != "" && !db.Country(country).Contains(net.ParseIP(ip)) {
+			t.Fatalf("%s: expect in %s", ip, country)
+		}
+	}
+}
+
+// testMMDB returns an IPv6 MaxMind DB with 1.0.0.0/8 and 2.0.0.0/8 in CN,
+// 8.0.0.0/8 registered in US, 240e::/20 in CN and ::ffff:0:0/96 aliased to the
+// IPv4 addresses.
+func testMMDB() []byte {
+	var data []byte
+	data = append(data, 0xe0|1) // map of 1
+	data = appendString(data, "country")
+	country := len(data)
+	data = append(data, 0xe0|1)
+	data = appendString(data, "iso_code")
+	data = appendString(data, "CN")
+	cn := 0
+	us := len(data)
+	data = append(data, 0xe0|1)
+	data = appendString(data, "registered_country")
+	data = append(data, 0xe0|1)
+	data = appendString(data, "iso_code")
+	data = appendString(data, "US")
+	cnPointer := len(data)
+	data = append(data, 0xe0|1)
+	data = appendString(data, "country")
+	data = append(data, 0x20|byte(country>>8), byte(country)) // pointer
+
+	root := &testNode{}
+	ipv4 := root.insert(make([]byte, 16), 96, -1)
+	ipv4.insert([]byte{1}, 8, cn)
+	ipv4.insert([]byte{2}, 8, cnPointer)
+	ipv4.insert([]byte{8}, 8, us)
+	root.insert(net.ParseIP("240e::"), 20, cn)
+	alias := root.insert(net.ParseIP("::ffff:0:0"), 95, -1)
+	alias.child[1] = ipv4
+
+	index := map[*testNode]int{}
+	nodes := root.number(nil, index)
+	nodeCount := len(nodes)
+	var tree []byte
+	for _, n := range nodes {
+		for bit := 0; bit < 2; bit++ {
+			v := nodeCount
+			if n.child[bit] != nil {
+				v = index[n.child[bit]]
+			} else if n.hasData[bit] {
+				v = nodeCount + 16 + n.data[bit]
+			}
+			tree = append(tree, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+
+	var meta []byte
+	meta = append(meta, 0xe0|3)
+	meta = appendString(meta, "node_count")
+	meta = append(meta, 0xc0|4)
+	meta = append(meta, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(meta[len(meta)-4:], uint32(nodeCount))
+	meta = appendString(meta, "record_size")
+	meta = append(meta, 0xa0|1, 24)
+	meta = appendString(meta, "ip_version")
+	meta = append(meta, 0xa0|1, 6)
+
+	buf := append(tree, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, "\xab\xcd\xefMaxMind.com"...)
+	return append(buf, meta...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, 0x40|byte(len(s)))
+	return append(b, s...)
+}
+
+type testNode struct {
+	child   [2]*testNode
+	data    [2]int
+	hasData [2]bool
+}
+
+// insert inserts the prefix of ip of length bits with the data offset, and
+// returns the node at the end of the prefix if data is negative.
+func (n *testNode) insert(ip []byte, bits int, data int) *testNode {
+	for i := 0; i < bits; i++ {
+		bit := ip[i/8] >> (7 - uint(i%8)) & 1
+		if i == bits-1 && data >= 0 {
+			n.data[bit], n.hasData[bit] = data, true
+			return nil
+		}
+		if n.child[bit] == nil {
+			n.child[bit] = &testNode{}
+		}
+		n = n.child[bit]
+	}
+	return n
+}
+
+func (n *testNode) number(nodes []*testNode, seen map[*testNode]int) []*testNode {
+	if _, ok := seen[n]; ok {
+		return nodes
+	}
+	seen[n] = len(nodes)
+	nodes = append(nodes, n)
+	for _, c := range n.child {
+		if c != nil {
+			nodes = c.number(nodes, seen)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,6 @@
+package geoip
+
+// Put the GeoLite2 Country database, either GeoLite2-Country.mmdb or the CSV
+// files, into data before running go generate. Add countries to compile into
+// Embedded as <code>=<name>, e.g. US=America.
+//go:generate go run ../cmd/geoip-gen -dir data CN=China
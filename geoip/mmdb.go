@@ -0,0 +1,393 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+
+	"h12.io/errors"
+)
+
+// mmdbMetadataStart marks the start of the metadata in a MaxMind DB file.
+var mmdbMetadataStart = []byte("\xab\xcd\xefMaxMind.com")
+
+// LoadMMDB loads a GeoLite2 or GeoIP2 Country database in the MaxMind DB
+// format, by walking through all the networks in its search tree.
+func LoadMMDB(file string) (*DB, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	r, err := newMMDBReader(buf)
+	if err != nil {
+		return nil, errors.Format("%s: %v", file, err)
+	}
+	db := &DB{}
+	if err := r.walk(db); err != nil {
+		return nil, errors.Format("%s: %v", file, err)
+	}
+	db.finish()
+	return db, nil
+}
+
+type mmdbReader struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	countries  map[uint]string // by data offset
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataStart)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	meta := buf[i+len(mmdbMetadataStart):]
+	v, _, err := (&mmdbDecoder{meta}).decode(0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid metadata")
+	}
+	r := &mmdbReader{countries: make(map[uint]string)}
+	for _, field := range []struct {
+		name  string
+		value *uint
+	}{
+		{"node_count", &r.nodeCount},
+		{"record_size", &r.recordSize},
+		{"ip_version", &r.ipVersion},
+	} {
+		n, ok := m[field.name].(uint64)
+		if !ok {
+			return nil, errors.Format("invalid metadata %s", field.name)
+		}
+		*field.value = uint(n)
+	}
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, errors.Format("unsupported record size %d", r.recordSize)
+	}
+	treeSize := r.recordSize * 2 / 8 * r.nodeCount
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("invalid search tree size")
+	}
+	r.tree = buf[:treeSize]
+	r.data = buf[treeSize+16 : i]
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node.
+func (r *mmdbReader) record(node uint, bit uint) uint {
+	b := r.tree[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	return uint(binary.BigEndian.Uint32(b[bit*4:]))
+}
+
+// walk adds all the networks with a country to db.
+func (r *mmdbReader) walk(db *DB) error {
+	var ip [16]byte
+	if r.ipVersion == 4 {
+		return r.walkNode(db, 0, ip[:4], 0)
+	}
+	// IPv4 addresses are in ::/96, which is also aliased from ::ffff:0:0/96
+	// and 2002::/16.
+	ipv4Start := uint(0)
+	for i := 0; i < 96 && ipv4Start < r.nodeCount; i++ {
+		ipv4Start = r.record(ipv4Start, 0)
+	}
+	var walk func(node uint, depth uint) error
+	walk = func(node uint, depth uint) error {
+		if depth == 96 && node == ipv4Start {
+			if ip == [16]byte{} {
+				return r.walkNode(db, node, ip[12:], 0)
+			}
+			return nil // alias
+		}
+		if node == ipv4Start && ip != [16]byte{} {
+			return nil // alias
+		}
+		return r.visit(db, node, ip[:], depth, walk)
+	}
+	return walk(0, 0)
+}
+
+// walkNode walks the subtree of an IPv4 or IPv6 address family, where ip is
+// the address of the family being built.
+func (r *mmdbReader) walkNode(db *DB, node uint, ip []byte, depth uint) error {
+	var walk func(node uint, depth uint) error
+	walk = func(node uint, depth uint) error {
+		return r.visit(db, node, ip, depth, walk)
+	}
+	return walk(node, depth)
+}
+
+// visit adds the networks of node at depth with prefix ip, calling walk for
+// the child nodes.
+func (r *mmdbReader) visit(db *DB, node uint, ip []byte, depth uint, walk func(node, depth uint) error) error {
+	if depth >= uint(len(ip))*8 {
+		return errors.New("search tree too deep")
+	}
+	for bit := uint(0); bit < 2; bit++ {
+		byteIndex, mask := depth/8, byte(0x80)>>(depth%8)
+		if bit == 1 {
+			ip[byteIndex] |= mask
+		} else {
+			ip[byteIndex] &^= mask
+		}
+		child := r.record(node, bit)
+		switch {
+		case child < r.nodeCount:
+			if err := walk(child, depth+1); err != nil {
+				return err
+			}
+		case child > r.nodeCount:
+			country, err := r.country(child - r.nodeCount - 16)
+			if err != nil {
+				return err
+			}
+			if country != "" {
+				r.add(db, ip, depth+1, country)
+			}
+		}
+	}
+	ip[depth/8] &^= byte(0x80) >> (depth % 8)
+	return nil
+}
+
+func (r *mmdbReader) add(db *DB, ip []byte, prefixLen uint, country string) {
+	lo := make([]byte, len(ip))
+	hi := make([]byte, len(ip))
+	for i := range ip {
+		var mask byte
+		switch {
+		case prefixLen >= uint(i+1)*8:
+			mask = 0xff
+		case prefixLen > uint(i)*8:
+			mask = ^(byte(0xff) >> (prefixLen - uint(i)*8))
+		}
+		lo[i] = ip[i] & mask
+		hi[i] = ip[i] | ^mask
+	}
+	if len(ip) == 4 {
+		db.addV4(ip4ToNum(lo), ip4ToNum(hi), country)
+	} else {
+		db.addV6(ip6ToNum(lo), ip6ToNum(hi), country)
+	}
+}
+
+// country returns the ISO code of the country, or the registered country, in
+// the data record at offset.
+func (r *mmdbReader) country(offset uint) (string, error) {
+	if c, ok := r.countries[offset]; ok {
+		return c, nil
+	}
+	v, _, err := (&mmdbDecoder{r.data}).decode(offset)
+	if err != nil {
+		return "", err
+	}
+	var code string
+	if m, ok := v.(map[string]interface{}); ok {
+		for _, key := range []string{"country", "registered_country"} {
+			if c, ok := m[key].(map[string]interface{}); ok {
+				if code, ok = c["iso_code"].(string); ok && code != "" {
+					break
+				}
+			}
+		}
+	}
+	r.countries[offset] = code
+	return code, nil
+}
+
+// mmdbDecoder decodes the data section format of the MaxMind DB, with
+// pointers relative to buf.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+var errMMDBData = errors.New("invalid MaxMind DB data")
+
+// decode returns the value at offset and the offset after it.
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	typ, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ == mmdbPointer {
+		v, _, err := d.decode(size)
+		return v, offset, err
+	}
+	if typ == mmdbMap || typ == mmdbArray {
+		return d.decodeContainer(typ, size, offset)
+	}
+	if typ == mmdbBool {
+		return size != 0, offset, nil
+	}
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, errMMDBData
+	}
+	b := d.buf[offset : offset+size]
+	offset += size
+	switch typ {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes, mmdbUint128:
+		return b, offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBData
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBData
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, errMMDBData
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, errMMDBData
+		}
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int32(n), offset, nil
+	}
+	return nil, 0, errors.Format("unsupported MaxMind DB data type %d", typ)
+}
+
+func (d *mmdbDecoder) decodeContainer(typ, size, offset uint) (interface{}, uint, error) {
+	if typ == mmdbArray {
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	}
+	m := make(map[string]interface{}, size)
+	for i := uint(0); i < size; i++ {
+		k, next, err := d.decode(offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, 0, errMMDBData
+		}
+		v, next, err := d.decode(next)
+		if err != nil {
+			return nil, 0, err
+		}
+		m[key] = v
+		offset = next
+	}
+	return m, offset, nil
+}
+
+// control decodes the control byte at offset, returning the type, the size
+// (or the target of a pointer) and the offset of the payload.
+func (d *mmdbDecoder) control(offset uint) (typ, size, next uint, err error) {
+	b := d.buf
+	if offset >= uint(len(b)) {
+		return 0, 0, 0, errMMDBData
+	}
+	ctrl := b[offset]
+	offset++
+	typ = uint(ctrl >> 5)
+	if typ == mmdbPointer {
+		n := uint(ctrl>>3) & 0x3
+		if offset+n+1 > uint(len(b)) {
+			return 0, 0, 0, errMMDBData
+		}
+		v := uint(ctrl & 0x7)
+		p := b[offset : offset+n+1]
+		switch n {
+		case 0:
+			size = v<<8 | uint(p[0])
+		case 1:
+			size = (v<<16 | uint(p[0])<<8 | uint(p[1])) + 2048
+		case 2:
+			size = (v<<24 | uint(p[0])<<16 | uint(p[1])<<8 | uint(p[2])) + 526336
+		case 3:
+			size = uint(binary.BigEndian.Uint32(p))
+		}
+		return typ, size, offset + n + 1, nil
+	}
+	if typ == mmdbExtended {
+		if offset >= uint(len(b)) {
+			return 0, 0, 0, errMMDBData
+		}
+		typ = 7 + uint(b[offset])
+		offset++
+	}
+	size = uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(b)) {
+			return 0, 0, 0, errMMDBData
+		}
+		var extra uint
+		for _, c := range b[offset : offset+n] {
+			extra = extra<<8 | uint(c)
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + extra
+		case 2:
+			size = 285 + extra
+		case 3:
+			size = 65821 + extra
+		}
+	}
+	return typ, size, offset, nil
+}
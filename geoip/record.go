@@ -1,6 +1,11 @@
 package geoip
 
-import "sort"
+import (
+	"encoding/binary"
+	"sort"
+
+	"h12.io/errors"
+)
 
 type (
 	IPNetV4 struct {
@@ -8,6 +13,14 @@ type (
 		Hi uint32
 	}
 	IPNetListV4 []IPNetV4
+
+	// IPv6 is an IPv6 address as a 128-bit number, the high 64 bits first.
+	IPv6    [2]uint64
+	IPNetV6 struct {
+		Lo IPv6
+		Hi IPv6
+	}
+	IPNetListV6 []IPNetV6
 )
 
 func (a IPNetListV4) Contains(ip []byte) bool {
@@ -27,3 +40,54 @@ func ip4ToNum(ip []byte) uint32 {
 		(uint32(ip[2]) << 8) |
 		(uint32(ip[3]))
 }
+
+// Contains returns true if the IPv6 address ip is in the list.
+func (a IPNetListV6) Contains(ip []byte) bool {
+	if len(ip) != 16 {
+		return false
+	}
+	ip6 := ip6ToNum(ip)
+	i := sort.Search(len(a), func(i int) bool {
+		return !a[i].Hi.less(ip6)
+	})
+	if i < len(a) {
+		return !ip6.less(a[i].Lo)
+	}
+	return false
+}
+
+func ip6ToNum(ip []byte) IPv6 {
+	return IPv6{binary.BigEndian.Uint64(ip[:8]), binary.BigEndian.Uint64(ip[8:])}
+}
+
+func (a IPv6) less(b IPv6) bool {
+	return a[0] < b[0] || a[0] == b[0] && a[1] < b[1]
+}
+
+// Validate returns an error if the ranges are not sorted, overlap or have Lo
+// greater than Hi.
+func (a IPNetListV4) Validate() error {
+	for i, n := range a {
+		if n.Lo > n.Hi {
+			return errors.Format("invalid range %d: %d > %d", i, n.Lo, n.Hi)
+		}
+		if i > 0 && n.Lo <= a[i-1].Hi {
+			return errors.Format("range %d is not sorted or overlaps", i)
+		}
+	}
+	return nil
+}
+
+// Validate returns an error if the ranges are not sorted, overlap or have Lo
+// greater than Hi.
+func (a IPNetListV6) Validate() error {
+	for i, n := range a {
+		if n.Hi.less(n.Lo) {
+			return errors.Format("invalid range %d: %x > %x", i, n.Lo, n.Hi)
+		}
+		if i > 0 && !a[i-1].Hi.less(n.Lo) {
+			return errors.Format("range %d is not sorted or overlaps", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package local
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"h12.io/errors"
+)
+
+// autoProxyRules holds rules in the AutoProxy syntax used by gfwlist:
+//     ! comment
+//     ||example.com       example.com and its subdomains, any scheme
+//     |http://example.com URLs starting with http://example.com
+//     example             URLs containing "example", * is a wildcard
+//     /^https?:\/\/x/     URLs matching the regular expression
+//     @@<rule>            exception, never proxied
+// An exception always wins over a proxy rule.
+type autoProxyRules struct {
+	proxy  autoProxyRuleSet
+	except autoProxyRuleSet
+}
+
+type autoProxyRuleSet struct {
+	domains  *domainTrie
+	prefixes []string
+	keywords []string
+	patterns []*regexp.Regexp
+}
+
+func newAutoProxyRules() *autoProxyRules {
+	return &autoProxyRules{
+		proxy:  autoProxyRuleSet{domains: newDomainTrie()},
+		except: autoProxyRuleSet{domains: newDomainTrie()},
+	}
+}
+
+// loadAutoProxyRules loads every file in dir. Files ending with .pac are PAC
+// files generated from AutoProxy rules, and the others are AutoProxy rule
+// files, optionally base64 encoded like gfwlist.txt.
+func loadAutoProxyRules(dir string) (*autoProxyRules, error) {
+	rules := newAutoProxyRules()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return rules, nil
+		}
+		return nil, errors.Wrap(err)
+	}
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		file := path.Join(dir, fi.Name())
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		if strings.HasSuffix(fi.Name(), ".pac") {
+			lines, err := extractPACRules(buf)
+			if err != nil {
+				return nil, errors.Format("%s: %s", file, err.Error())
+			}
+			for _, line := range lines {
+				rules.add(line)
+			}
+		} else {
+			rules.parse(decodeGFWList(buf))
+		}
+		log.Printf("rules loaded from %s", file)
+	}
+	return rules, nil
+}
+
+// decodeGFWList decodes a base64 wrapped rule file, or returns buf as it is.
+func decodeGFWList(buf []byte) []byte {
+	trimmed := bytes.TrimSpace(buf)
+	if bytes.HasPrefix(trimmed, []byte("[AutoProxy")) || bytes.HasPrefix(trimmed, []byte("!")) {
+		return buf
+	}
+	decoded, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding,
+		bytes.NewReader(bytes.Join(bytes.Fields(trimmed), nil))))
+	if err != nil {
+		return buf
+	}
+	return decoded
+}
+
+// extractPACRules extracts AutoProxy rules from a PAC file generated by tools
+// like gfwlist2pac or genpac, which embed the rules as a JavaScript array of
+// strings, e.g. "var rules = [...];".
+func extractPACRules(buf []byte) ([]string, error) {
+	loc := regexp.MustCompile(`(?:var|let|const)\s+(?:rules|RULES)\s*=\s*\[`).FindIndex(buf)
+	if loc == nil {
+		return nil, errors.New("no AutoProxy rules array found in the PAC file")
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf[loc[1]-1:]))
+	var rules []string
+	if err := dec.Decode(&rules); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return rules, nil
+}
+
+func (r *autoProxyRules) parse(buf []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		r.add(scanner.Text())
+	}
+}
+
+func (r *autoProxyRules) add(rule string) {
+	rule = strings.TrimSpace(rule)
+	if rule == "" || strings.HasPrefix(rule, "!") || strings.HasPrefix(rule, "[") {
+		return
+	}
+	set := &r.proxy
+	if strings.HasPrefix(rule, "@@") {
+		set, rule = &r.except, rule[2:]
+	}
+	if err := set.add(rule); err != nil {
+		log.Printf("ignore rule %s: %s", rule, err.Error())
+	}
+}
+
+func (s *autoProxyRuleSet) add(rule string) error {
+	switch {
+	case strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/") && len(rule) > 2:
+		re, err := regexp.Compile(rule[1 : len(rule)-1])
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		s.patterns = append(s.patterns, re)
+	case strings.HasPrefix(rule, "||"):
+		domain := rule[2:]
+		if !strings.ContainsAny(domain, "/*^|") {
+			s.domains.add("." + domain)
+			return nil
+		}
+		re, err := regexp.Compile(`^[a-z][a-z0-9+.-]*://([^/]+\.)?` + wildcardPattern(domain))
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		s.patterns = append(s.patterns, re)
+	case strings.HasPrefix(rule, "|"):
+		prefix := rule[1:]
+		if !strings.ContainsAny(prefix, "*^|") {
+			s.prefixes = append(s.prefixes, prefix)
+			return nil
+		}
+		re, err := regexp.Compile("^" + wildcardPattern(prefix))
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		s.patterns = append(s.patterns, re)
+	default:
+		if !strings.ContainsAny(rule, "*^|") {
+			s.keywords = append(s.keywords, rule)
+			return nil
+		}
+		re, err := regexp.Compile(wildcardPattern(rule))
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		s.patterns = append(s.patterns, re)
+	}
+	return nil
+}
+
+// wildcardPattern converts an AutoProxy pattern to a regular expression: * is
+// any string, ^ is a separator and a trailing | anchors the end.
+func wildcardPattern(rule string) string {
+	anchored := strings.HasSuffix(rule, "|")
+	rule = strings.TrimSuffix(rule, "|")
+	p := regexp.QuoteMeta(rule)
+	p = strings.Replace(p, `\*`, ".*", -1)
+	p = strings.Replace(p, `\^`, `([^\w.%-]|$)`, -1)
+	if anchored {
+		p += "$"
+	}
+	return p
+}
+
+func (s *autoProxyRuleSet) match(u *url.URL) bool {
+	if n, _ := s.domains.match(u.Host); n > 0 {
+		return true
+	}
+	str := u.String()
+	for _, prefix := range s.prefixes {
+		if strings.HasPrefix(str, prefix) {
+			return true
+		}
+	}
+	for _, keyword := range s.keywords {
+		if strings.Contains(str, keyword) {
+			return true
+		}
+	}
+	for _, re := range s.patterns {
+		if re.MatchString(str) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *autoProxyRules) route(u *url.URL) route {
+	switch {
+	case r.except.match(u):
+		return routeDirect
+	case r.proxy.match(u):
+		return routeRemote
+	}
+	return routeSmart
+}
@@ -0,0 +1,60 @@
+package local
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+)
+
+const testGFWList = `[AutoProxy 0.2.9]
+! comment
+||blocked.com
+|http://prefix.com/path
+keyword
+|https://*.wild.org
+/^https?:\/\/[^\/]+regex\.net/
+@@||ok.blocked.com
+@@|http://keyword.ok
+`
+
+func TestAutoProxyRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "gfwlist.txt"), []byte(base64.StdEncoding.EncodeToString([]byte(testGFWList))), 0600)
+	ioutil.WriteFile(path.Join(dir, "proxy.pac"), []byte(`var proxy = "PROXY 127.0.0.1:1984;";
+var rules = [
+  "||pac.com",
+  "@@||direct.pac.com"
+];
+function FindProxyForURL(url, host) { return proxy; }`), 0600)
+	rules, err := loadAutoProxyRules(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rawurl, expected := range map[string]route{
+		"https://blocked.com":          routeRemote,
+		"http://www.blocked.com/x":     routeRemote,
+		"https://ok.blocked.com":       routeDirect,
+		"http://prefix.com/path/a":     routeRemote,
+		"http://prefix.com/other":      routeSmart,
+		"http://a.com/keyword?x":       routeRemote,
+		"http://keyword.ok/":           routeDirect,
+		"https://www.wild.org":         routeRemote,
+		"http://www.wild.org":          routeSmart,
+		"https://www.regex.net/":       routeRemote,
+		"https://notblocked.com":       routeSmart,
+		"https://pac.com":              routeRemote,
+		"https://www.direct.pac.com:8": routeDirect,
+	} {
+		u, _ := url.Parse(rawurl)
+		if got := rules.route(u); got != expected {
+			t.Errorf("%s: expect %v, got %v", rawurl, expected, got)
+		}
+	}
+}
@@ -2,82 +2,336 @@ package local
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/url"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
-	"h12.io/egress/geoip"
 	"h12.io/errors"
 )
 
+type route int
+
+const (
+	routeSmart  route = iota // try direct first, then remote
+	routeDirect              // never proxy
+	routeRemote              // always proxy
+)
+
+// blockList decides the route of a URL by domain rules in two files: the
+// block list, learned automatically, and the direct list, maintained by hand.
+// When both lists match a host, the more specific rule wins, and the direct
+// list wins a tie. AutoProxy rules are consulted after the direct list and
+// before the learned block list.
 type blockList struct {
-	m    map[string]struct{}
-	file string
-	mu   sync.Mutex
+	block     *domainTrie
+	entries   map[string]*blockEntry // by rule
+	direct    *domainTrie
+	rules     *autoProxyRules
+	countries *countryPolicy
+	dns       *resolver
+	file      string
+	modTime   time.Time // of the file when last loaded or saved
+	version   int       // increased on every change of the rules
+	dirty     bool      // entries changed since the last save
+	probeTTL  time.Duration
+	probes    int // max concurrent probes
+	mu        sync.Mutex
+}
+
+// blockEntry is a learned rule with its statistics. The block list file
+// stores one entry per line in JSON. A line with a bare rule is also accepted
+// for compatibility.
+type blockEntry struct {
+	Rule      string    `json:"rule"`
+	Host      string    `json:"host,omitempty"` // host:port learned from
+	FirstSeen time.Time `json:"first_seen"`
+	LastUsed  time.Time `json:"last_used,omitempty"`
+	Probed    time.Time `json:"probed,omitempty"`
+	Class     string    `json:"class,omitempty"` // failureClass
+	Reason    string    `json:"reason,omitempty"`
+	Hits      int64     `json:"hits"`
+}
+
+func newBlockList(listFile, directFile, rulesDir, countriesFile string, dns *resolver) (*blockList, error) {
+	l := &blockList{
+		dns:     dns,
+		block:   newDomainTrie(),
+		entries: make(map[string]*blockEntry),
+		file:    listFile,
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	direct, err := loadDomainRules(directFile)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := loadAutoProxyRules(rulesDir)
+	if err != nil {
+		return nil, err
+	}
+	countries, err := loadCountryPolicy(countriesFile)
+	if err != nil {
+		return nil, err
+	}
+	l.direct, l.rules, l.countries = direct, rules, countries
+	return l, nil
+}
+
+func (l *blockList) load() error {
+	f, err := os.Open(l.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	l.modTime = info.ModTime()
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		e := &blockEntry{Rule: line, FirstSeen: info.ModTime()}
+		if strings.HasPrefix(line, "{") {
+			if err := json.Unmarshal([]byte(line), e); err != nil {
+				return errors.Format("%s:%d: %s", l.file, lineNum, err.Error())
+			}
+		}
+		domain, exact, wildcard := parseDomainRule(e.Rule)
+		e.Rule = canonicalRule(domain, exact, wildcard)
+		if l.block.add(e.Rule) {
+			l.entries[e.Rule] = e
+		}
+	}
+	if scanner.Err() != nil {
+		return errors.Wrap(scanner.Err())
+	}
+	return nil
+}
+
+// saveLocked writes all entries to a temporary file and renames it to the
+// block list file.
+func (l *blockList) saveLocked() error {
+	entries := make([]*blockEntry, 0, len(l.entries))
+	for _, e := range l.entries {
+		entries = append(entries, e)
+	}
+	sort.Sort(byReversedRule(entries))
+	var buf bytes.Buffer
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	tmp := l.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return errors.Wrap(err)
+	}
+	if err := os.Rename(tmp, l.file); err != nil {
+		return errors.Wrap(err)
+	}
+	if info, err := os.Stat(l.file); err == nil {
+		l.modTime = info.ModTime()
+	}
+	l.dirty = false
+	return nil
+}
+
+// changedOnDiskLocked returns true if the file has been changed by others
+// since last loaded or saved.
+func (l *blockList) changedOnDiskLocked() bool {
+	info, err := os.Stat(l.file)
+	if err != nil {
+		return !l.modTime.IsZero()
+	}
+	return !info.ModTime().Equal(l.modTime)
+}
+
+// replace replaces the rules with the ones of n, which is loaded from the
+// files of a new configuration. The learned entries are kept unless the block
+// list file is changed, in which case the entries are saved first if it is
+// moved, or dropped if it is edited by others.
+func (l *blockList) replace(n *blockList) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n.file != l.file || l.changedOnDiskLocked() {
+		if n.file != l.file && l.dirty {
+			if err := l.saveLocked(); err != nil {
+				return err
+			}
+		}
+		l.block, l.entries, l.file, l.modTime, l.dirty = n.block, n.entries, n.file, n.modTime, false
+	}
+	l.direct, l.rules, l.countries, l.dns = n.direct, n.rules, n.countries, n.dns
+	l.version++
+	return nil
 }
 
-// to sort the block list file:
-//     rev blocklist | sort | rev
+func (l *blockList) changedOnDisk() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.changedOnDiskLocked()
+}
 
-func newBlockList(listFile string) (*blockList, error) {
-	m := make(map[string]struct{})
-	f, err := os.OpenFile(listFile, os.O_RDONLY|os.O_CREATE, 0600)
+// resolver returns the resolver of the current configuration.
+func (l *blockList) resolver() *resolver {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dns
+}
+
+func (l *blockList) save() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.dirty {
+		return nil
+	}
+	return l.saveLocked()
+}
+
+// byReversedRule sorts entries of the same site together.
+type byReversedRule []*blockEntry
+
+func (a byReversedRule) Len() int      { return len(a) }
+func (a byReversedRule) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byReversedRule) Less(i, j int) bool {
+	return reverseString(a[i].Rule) < reverseString(a[j].Rule)
+}
+
+func reverseString(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+func loadDomainRules(file string) (*domainTrie, error) {
+	t := newDomainTrie()
+	f, err := os.Open(file)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return &blockList{m: m, file: listFile}, nil
+			return t, nil
 		}
 		return nil, errors.Wrap(err)
 	}
 	defer f.Close()
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
-		m[scanner.Text()] = struct{}{}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		t.add(line)
 	}
 	if scanner.Err() != nil {
 		return nil, errors.Wrap(scanner.Err())
 	}
-	return &blockList{m: m, file: listFile}, nil
+	return t, nil
 }
 
-func (l *blockList) has(host string) bool {
+func (l *blockList) route(u *url.URL) route {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	_, ok := l.m[host]
-	return ok
+	r, rule := l.routeLocked(u.Host)
+	if r == routeDirect {
+		return r
+	}
+	if ruleRoute := l.rules.route(u); ruleRoute != routeSmart {
+		return ruleRoute
+	}
+	if e := l.entries[rule]; e != nil && r == routeRemote {
+		e.Hits++
+		e.LastUsed = time.Now()
+		l.dirty = true
+	}
+	return r
+}
+
+// routeLocked returns the route by the domain rules and the matched rule in
+// the block list.
+func (l *blockList) routeLocked(host string) (route, string) {
+	block, rule := l.block.match(host)
+	direct, _ := l.direct.match(host)
+	switch {
+	case direct > 0 && direct >= block:
+		return routeDirect, ""
+	case block > 0:
+		return routeRemote, rule
+	}
+	return routeSmart, ""
 }
 
-func (l *blockList) add(host string) error {
-	if ip := lookupIP(host); ip != nil && geoip.ChinaList.Contains(ip) {
-		log.Printf("Host %s in China, fetch remotely but not added", host)
+// add learns the whole site of hostPort as blocked, for the failure class and
+// reason of the direct connection.
+func (l *blockList) add(hostPort string, class failureClass, reason string) error {
+	host := normalizeHost(hostPort)
+	if l.routeCountry(host) == routeDirect {
+		log.Printf("Host %s in a direct country, fetch remotely but not added", host)
 		return nil
 	}
-	log.Printf("ADD HOST: %s", host)
 
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	if _, ok := l.m[host]; !ok {
-		l.m[host] = struct{}{}
-		f, err := os.OpenFile(l.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, os.ModeAppend)
-		if err != nil {
-			return errors.Wrap(err)
-		}
-		defer f.Close()
-		f.WriteString(host)
-		f.Write([]byte{'\n'})
+	if r, _ := l.routeLocked(host); r == routeDirect {
+		log.Printf("Host %s in direct list, not added", host)
+		return nil
 	}
-	return nil
+	rule := siteRule(host)
+	if !l.block.add(rule) {
+		return nil
+	}
+	l.version++
+	log.Printf("ADD RULE: %s (host %s): %s: %s", rule, host, class, reason)
+	now := time.Now()
+	l.entries[rule] = &blockEntry{
+		Rule:      rule,
+		Host:      hostPort,
+		FirstSeen: now,
+		LastUsed:  now,
+		Class:     string(class),
+		Reason:    reason,
+		Hits:      1,
+	}
+	return l.saveLocked()
 }
 
-func lookupIP(host string) net.IP {
-	if addrs, err := net.LookupIP(host); err == nil {
-		for _, ip := range addrs {
-			ip = ip.To4()
-			if ip != nil {
-				return ip // return first IPv4 address
-			}
-		}
+// demote removes an entry that can be reached directly again.
+func (l *blockList) demote(rule string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.block.remove(rule) {
+		return nil
+	}
+	delete(l.entries, rule)
+	l.version++
+	log.Printf("DEMOTE RULE: %s", rule)
+	return l.saveLocked()
+}
+
+func (l *blockList) lookupIP(host string) []net.IP {
+	if a, err := l.resolver().lookup(context.Background(), host); err == nil {
+		return a.ips
 	}
 	// ignore error
 	return nil
@@ -0,0 +1,141 @@
+package local
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDomainTrie(t *testing.T) {
+	trie := newDomainTrie()
+	for _, rule := range []string{"exact.com", "*.wild.com", ".suffix.com", "A.Mixed.COM."} {
+		trie.add(rule)
+	}
+	for host, match := range map[string]bool{
+		"exact.com":         true,
+		"www.exact.com":     false,
+		"wild.com":          false,
+		"www.wild.com":      true,
+		"a.b.wild.com":      true,
+		"suffix.com":        true,
+		"img.suffix.com:80": true,
+		"notsuffix.com":     false,
+		"a.mixed.com":       true,
+		"com":               false,
+		"":                  false,
+	} {
+		if n, _ := trie.match(host); (n > 0) != match {
+			t.Errorf("%q: expect %v", host, match)
+		}
+	}
+}
+
+func TestBlockListRoute(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "blocklist"), []byte("old.example.org\n.example.com\n"), 0600)
+	ioutil.WriteFile(path.Join(dir, "directlist"), []byte("# comment\ncdn.example.com\n.example.com\n"), 0600)
+	l, err := newBlockList(path.Join(dir, "blocklist"), path.Join(dir, "directlist"), path.Join(dir, "rules"), path.Join(dir, "countries"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, expected := range map[string]route{
+		"old.example.org":     routeRemote,
+		"www.example.org":     routeSmart,
+		"example.com":         routeDirect, // tie goes to the direct list
+		"www.example.com":     routeDirect,
+		"cdn.example.com:443": routeDirect,
+	} {
+		if got := l.route(connectURL(host)); got != expected {
+			t.Errorf("%s: expect %v, got %v", host, expected, got)
+		}
+	}
+
+	if err := l.add("img.blocked.co.uk:443", failureReset, "connection reset"); err != nil {
+		t.Fatal(err)
+	}
+	if l.route(connectURL("www.blocked.co.uk:443")) != routeRemote || l.route(connectURL("co.uk:443")) != routeSmart {
+		t.Fatal("expect the whole site to be learned")
+	}
+	l, err = newBlockList(path.Join(dir, "blocklist"), path.Join(dir, "directlist"), path.Join(dir, "rules"), path.Join(dir, "countries"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.route(connectURL("blocked.co.uk:443")) != routeRemote {
+		t.Fatal("learned rule is not saved")
+	}
+}
+
+func TestBlockListProbe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+
+	file := path.Join(dir, "blocklist")
+	old := time.Now().Add(-time.Hour).UTC()
+	var lines []string
+	for rule, host := range map[string]string{
+		"reachable.test":   ln.Addr().String(),
+		"unreachable.test": closed.Addr().String(),
+	} {
+		line, _ := json.Marshal(&blockEntry{Rule: rule, Host: host, FirstSeen: old})
+		lines = append(lines, string(line))
+	}
+	ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\nlegacy.test\n"), 0600)
+	l, err := newBlockList(file, path.Join(dir, "directlist"), path.Join(dir, "rules"), path.Join(dir, "countries"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.entries) != 3 {
+		t.Fatalf("expect 3 entries, got %d", len(l.entries))
+	}
+	l.route(connectURL("unreachable.test:443"))
+	if e := l.entries["unreachable.test"]; e.Hits != 1 || e.LastUsed.IsZero() {
+		t.Fatalf("hit is not counted: %+v", e)
+	}
+
+	// legacy.test is not due yet because it is as new as the file
+	l.probe(time.Minute, 2)
+	if _, ok := l.entries["reachable.test"]; ok {
+		t.Fatal("reachable entry is not demoted")
+	}
+	if e := l.entries["unreachable.test"]; e == nil || e.Probed.IsZero() || e.Reason == "" {
+		t.Fatalf("unreachable entry is not updated: %+v", e)
+	}
+	if err := l.save(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = newBlockList(file, path.Join(dir, "directlist"), path.Join(dir, "rules"), path.Join(dir, "countries"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.entries) != 2 || l.entries["unreachable.test"].Hits != 1 {
+		t.Fatalf("entries are not saved: %v", l.entries)
+	}
+}
@@ -0,0 +1,190 @@
+package local
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	stderrors "errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// failureClass tells why a direct connection failed. Only failures caused by
+// interference lead to learning a host as blocked; ordinary failures, like a
+// refused port or a domain that does not exist, do not.
+type failureClass string
+
+const (
+	failurePoisoned failureClass = "dns-poisoned" // forged DNS answer
+	failureReset    failureClass = "reset"        // reset or cut during the handshake
+	failureTimeout  failureClass = "timeout"      // dropped silently
+	failureBadCert  failureClass = "bad-cert"     // TLS certificate not matching the host
+	failureNXDomain failureClass = "nxdomain"
+	failureDNS      failureClass = "dns"
+	failureRefused  failureClass = "refused"
+	failureOther    failureClass = "other"
+)
+
+func (c failureClass) interference() bool {
+	switch c {
+	case failurePoisoned, failureReset, failureTimeout, failureBadCert:
+		return true
+	}
+	return false
+}
+
+// poisonedIPs are answers known to be forged by the GFW.
+var poisonedIPs = map[string]bool{
+	"4.36.66.178":     true,
+	"8.7.198.45":      true,
+	"37.61.54.158":    true,
+	"46.82.174.68":    true,
+	"59.24.3.173":     true,
+	"64.33.88.161":    true,
+	"64.33.99.47":     true,
+	"64.66.163.251":   true,
+	"65.104.202.252":  true,
+	"65.160.219.113":  true,
+	"66.45.252.237":   true,
+	"72.14.205.99":    true,
+	"72.14.205.104":   true,
+	"78.16.49.15":     true,
+	"93.46.8.89":      true,
+	"128.121.126.139": true,
+	"159.106.121.75":  true,
+	"169.132.13.103":  true,
+	"192.67.198.6":    true,
+	"202.106.1.2":     true,
+	"202.181.7.85":    true,
+	"203.98.7.65":     true,
+	"203.161.230.171": true,
+	"207.12.88.98":    true,
+	"208.56.31.43":    true,
+	"209.36.73.33":    true,
+	"209.145.54.50":   true,
+	"209.220.30.174":  true,
+	"211.94.66.147":   true,
+	"213.169.251.35":  true,
+	"216.221.188.182": true,
+	"216.234.179.13":  true,
+	"243.185.187.39":  true,
+}
+
+// isPoisoned returns true if any answer is a known forged one, or a reserved
+// address that a public domain should not resolve to.
+func isPoisoned(host string, ips []net.IP) bool {
+	if net.ParseIP(host) != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if poisonedIPs[ip.String()] {
+			return true
+		}
+		if ip4 := ip.To4(); ip4 != nil && (ip4[0] == 0 || ip4[0] >= 240) {
+			return true
+		}
+	}
+	return false
+}
+
+// poisonedError is returned when the DNS answers of a host are forged, with
+// the error dialing the trusted answers if any.
+type poisonedError struct {
+	host  string
+	ips   []net.IP
+	cause error
+}
+
+func (e *poisonedError) Error() string {
+	if e.cause != nil {
+		return "forged DNS answer for " + e.host + ": " + e.cause.Error()
+	}
+	return "forged DNS answer for " + e.host
+}
+
+// classifyFailure classifies the error of a direct connection to host. If the
+// error does not tell, the answers of r, usually cached by the failed
+// connection, tell if the DNS is forged. A nil r skips the check.
+func classifyFailure(r *resolver, host string, err error) failureClass {
+	var poisoned *poisonedError
+	if stderrors.As(err, &poisoned) {
+		return failurePoisoned
+	}
+	if r != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+		a, lookupErr := r.lookup(ctx, normalizeHost(host))
+		cancel()
+		if lookupErr == nil && a.poisoned {
+			return failurePoisoned
+		}
+	}
+
+	var dnsErr *net.DNSError
+	if stderrors.As(err, &dnsErr) {
+		switch {
+		case dnsErr.IsNotFound:
+			return failureNXDomain
+		case dnsErr.IsTimeout:
+			return failureTimeout
+		}
+		return failureDNS
+	}
+	var certErr x509.HostnameError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var recordErr tls.RecordHeaderError
+	if stderrors.As(err, &certErr) || stderrors.As(err, &unknownAuthErr) || stderrors.As(err, &recordErr) {
+		return failureBadCert
+	}
+	switch {
+	case stderrors.Is(err, syscall.ECONNRESET):
+		return failureReset
+	case stderrors.Is(err, syscall.ECONNREFUSED):
+		return failureRefused
+	case stderrors.Is(err, io.EOF), stderrors.Is(err, io.ErrUnexpectedEOF):
+		return failureReset
+	}
+	var netErr net.Error
+	if stderrors.As(err, &netErr) && netErr.Timeout() {
+		return failureTimeout
+	}
+
+	// errors wrapped without Unwrap
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "connection reset"):
+		return failureReset
+	case strings.Contains(msg, "connection refused"):
+		return failureRefused
+	case strings.Contains(msg, "no such host"):
+		return failureNXDomain
+	case strings.Contains(msg, "timeout"):
+		return failureTimeout
+	case isEOF(err):
+		return failureReset
+	}
+	return failureOther
+}
+
+// countingConn counts the bytes read, to tell if a connection is cut before
+// the server says anything.
+type countingConn struct {
+	net.Conn
+	n int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
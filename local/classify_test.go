@@ -0,0 +1,70 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	r := newResolver(nil)
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := closed.Addr().String()
+	closed.Close()
+	_, err := r.dial(context.Background(), addr, time.Second)
+	if class := classifyFailure(r, addr, err); class != failureRefused || class.interference() {
+		t.Fatalf("expect refused, got %s", class)
+	}
+
+	_, err = r.dial(context.Background(), "nonexistent.invalid:443", time.Second)
+	if class := classifyFailure(r, "nonexistent.invalid:443", err); class.interference() {
+		t.Fatalf("expect no interference for NXDOMAIN, got %s", class)
+	}
+
+	err = &poisonedError{"example.com", []net.IP{net.ParseIP("93.46.8.89")}, nil}
+	if class := classifyFailure(r, "example.com:443", err); class != failurePoisoned || !class.interference() {
+		t.Fatalf("expect poisoned, got %s", class)
+	}
+	r.cache["forged.example.com"] = &dnsAnswer{
+		ips:      []net.IP{net.ParseIP("93.184.216.34")},
+		local:    []net.IP{net.ParseIP("93.46.8.89")},
+		trusted:  true,
+		poisoned: true,
+		expires:  time.Now().Add(time.Minute),
+	}
+	err = errors.New("dial tcp 93.184.216.34:443: i/o timeout")
+	if class := classifyFailure(r, "forged.example.com:443", err); class != failurePoisoned {
+		t.Fatalf("expect poisoned by the answers of the resolver, got %s", class)
+	}
+	if class := classifyFailure(nil, "forged.example.com:443", err); class != failureTimeout {
+		t.Fatalf("expect timeout without a resolver, got %s", class)
+	}
+	if !isPoisoned("example.com", []net.IP{net.ParseIP("243.185.187.39")}) ||
+		isPoisoned("example.com", []net.IP{net.ParseIP("93.184.216.34")}) {
+		t.Fatal("wrong poisoning detection")
+	}
+
+	// a server cutting the connection right after the client hello
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Read(make([]byte, 1))
+		conn.(*net.TCPConn).SetLinger(0) // RST
+		conn.Close()
+	}()
+	conn, err := r.dial(context.Background(), ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("client hello"))
+	_, err = conn.Read(make([]byte, 1))
+	if class := classifyFailure(r, ln.Addr().String(), err); class != failureReset {
+		t.Fatalf("expect reset, got %s: %v", class, err)
+	}
+}
@@ -0,0 +1,184 @@
+package local
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg, err := LoadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, DefaultConfig(dir)) {
+		t.Fatalf("expect the default config, got %#v", cfg)
+	}
+
+	ioutil.WriteFile(path.Join(dir, ConfigFile), []byte(`
+# comment
+[listen]
+socks = "127.0.0.1:1080" # comment
+socks_auth = 'user:pa"ss'
+
+[ remote ]
+url = "https://example.com/egress"
+mux = 0
+
+[route]
+race = "300ms"
+block_list = "/var/lib/egress/blocklist"
+probes = 1_0
+
+[tls]
+insecure_skip_verify = true
+
+[log]
+flags = ["date", "microseconds",]
+`), 0600)
+	cfg, err = LoadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := DefaultConfig(dir)
+	expected.Listen.SOCKS = "127.0.0.1:1080"
+	expected.Listen.SOCKSAuth = `user:pa"ss`
+	expected.Remote.URL = "https://example.com/egress"
+	expected.Remote.Mux = 0
+	expected.Route.Race = 300 * time.Millisecond
+	expected.Route.BlockList = "/var/lib/egress/blocklist"
+	expected.Route.Probes = 10
+	expected.TLS.InsecureSkipVerify = true
+	expected.Log.Flags = []string{"date", "microseconds"}
+	expected.sources = cfg.sources
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Fatalf("expect\n%#v\ngot\n%#v", expected, cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Path(cfg.Route.BlockList) != "/var/lib/egress/blocklist" || cfg.Path(cfg.Route.DirectList) != path.Join(dir, "directlist") {
+		t.Fatal("wrong path")
+	}
+	if user, password := cfg.Listen.SOCKSUser(); user != "user" || password != `pa"ss` {
+		t.Fatalf("wrong SOCKS user %s:%s", user, password)
+	}
+}
+
+func TestConfigRemotes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, ConfigFile)
+
+	ioutil.WriteFile(file, []byte(`
+[remotes.us]
+url = "https://us.example.com/egress"
+weight = 3
+group = "us"
+[remotes.jp]
+url = "https://jp.example.com"
+`), 0600)
+	cfg, err := LoadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remotes, err := cfg.remoteServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remotes) != 2 ||
+		remotes[0].name != "jp" || remotes[0].weight != 1 || remotes[0].endpoint("c").String() != "https://jp.example.com/c" ||
+		remotes[1].name != "us" || remotes[1].weight != 3 || remotes[1].group != "us" || remotes[1].endpoint("f").String() != "https://us.example.com/egress/f" {
+		t.Fatalf("wrong remotes %v", remotes)
+	}
+
+	if err := cfg.Set("remote.url", "https://example.com", "flag -remote"); err != nil {
+		t.Fatal(err)
+	}
+	remotes, err = cfg.remoteServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remotes) != 3 || remotes[0].name != "default" || remotes[0].url.Host != "example.com" {
+		t.Fatalf("expect the remote URL set explicitly added, got %v", remotes)
+	}
+}
+
+func TestConfigError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, ConfigFile)
+
+	for _, testcase := range []struct {
+		content  string
+		expected string
+	}{
+		{"[route]\nfetch = \"remote\"\nconnect = \"fast\"\n", ConfigFile + ":3: route.connect: expect smart"},
+		{"[route]\nprobes = \"4\"\n", ConfigFile + ":2: route.probes: expect an integer"},
+		{"[timeout]\ndial = 10\n", ConfigFile + ":2: timeout.dial: expect a duration"},
+		{"[timeout]\ndial = \"0s\"\n", ConfigFile + ":2: timeout.dial: invalid duration"},
+		{"[remote]\nurl = \"socks5://example.com\"\n", ConfigFile + ":2: remote.url: expect an http or https URL"},
+		{"[remote]\nhost = \"example.com\"\n", ConfigFile + ":2: remote.host: unknown key"},
+		{"[remote]\n[remote]\n", ConfigFile + ":2: duplicate table remote"},
+		{"remote = 1\n", ConfigFile + ":1: remote: unknown key"},
+		{"[listen]\nhttp = \"1984\"\n", ConfigFile + ":2: listen.http: expect <host>:<port>"},
+		{"[listen]\nhttp = \"unterminated\n", ConfigFile + ":2: listen.http: unterminated string"},
+		{"[log]\nflags = [\"date\" \"time\"]\n", ConfigFile + ":2: log.flags: expect , or ]"},
+		{"[log]\nflags = [\"date\", \"nanoseconds\"]\n", ConfigFile + ":2: log.flags: unknown flag"},
+		{"[tls]\nca = \"missing.pem\"\n", ConfigFile + ":2: tls.ca:"},
+		{"[remotes.us]\nurl = \"https://us.example.com\"\nweight = -1\n", ConfigFile + ":3: remotes.us.weight: expect 1 or more"},
+		{"[upstream]\nremote = \"https://proxy.example.com\"\n", ConfigFile + ":2: upstream.remote: expect an http or socks5 URL"},
+		{"[remotes.us]\nhost = \"us.example.com\"\n", ConfigFile + ":2: remotes.us.host: unknown key"},
+		{"[remote]\nurl = \"https://example.com\"\n[remotes.default]\nurl = \"https://us.example.com\"\n", ConfigFile + ":2: remote.url: conflict"},
+	} {
+		ioutil.WriteFile(file, []byte(testcase.content), 0600)
+		cfg, err := LoadConfig(dir)
+		if err == nil {
+			err = cfg.Validate()
+		}
+		if err == nil || !strings.Contains(err.Error(), testcase.expected) {
+			t.Fatalf("expect error %q for %q, got %v", testcase.expected, testcase.content, err)
+		}
+	}
+}
+
+func TestConfigSet(t *testing.T) {
+	cfg := DefaultConfig("")
+	for key, value := range map[string]string{
+		"route.fetch":     "remote",
+		"remote.mux":      "4",
+		"route.block_ttl": "1h0m0s",
+		"log.flags":       "date, utc",
+	} {
+		if err := cfg.Set(key, value, "flag"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cfg.Route.Fetch != "remote" || cfg.Remote.Mux != 4 || cfg.Route.BlockTTL != time.Hour ||
+		!reflect.DeepEqual(cfg.Log.Flags, []string{"date", "utc"}) {
+		t.Fatalf("wrong config %#v", cfg)
+	}
+	if err := cfg.Set("remote.mux", "many", "flag -mux"); err == nil || !strings.Contains(err.Error(), "flag -mux: remote.mux: ") {
+		t.Fatalf("expect error of the flag, got %v", err)
+	}
+	cfg.Set("route.connect", "fast", "flag -connect")
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "flag -connect: route.connect: ") {
+		t.Fatalf("expect error of the flag, got %v", err)
+	}
+}
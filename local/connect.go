@@ -2,13 +2,14 @@ package local
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
-	"path"
+	"time"
 
 	"h12.io/egress/protocol"
 	"h12.io/errors"
@@ -18,21 +19,19 @@ type connector interface {
 	connect(w http.ResponseWriter, host string) error
 }
 
-func newConnector(typ string, remote *url.URL, fetcher fetcher, blockList *blockList, workDir string) (connector, error) {
-	connectRemote := *remote
-	connectRemote.Path = path.Join(connectRemote.Path, "/c")
+func newConnector(typ string, remotes *remoteSet, fetcher fetcher, blockList *blockList, dns *resolver, certDir string, raceDelay time.Duration) (connector, error) {
 	switch typ {
 	case "direct":
 		log.Print("connect DIRECTLY only!")
-		return &directConnector{}, nil
+		return &directConnector{dns}, nil
 	case "remote":
 		log.Print("connect to REMOTE only!")
-		return &remoteConnector{&connectRemote}, nil
+		return &remoteConnector{remotes}, nil
 	case "smart":
-		return newSmartConnector(&connectRemote, blockList), nil
+		return newSmartConnector(remotes, blockList, dns, raceDelay), nil
 	case "faketls":
 		log.Print("connect with FAKE TLS connector!")
-		certs, err := newCertPool(path.Join(workDir, "cert"))
+		certs, err := newCertPool(certDir)
 		if err != nil {
 			return nil, err
 		}
@@ -43,62 +42,187 @@ func newConnector(typ string, remote *url.URL, fetcher fetcher, blockList *block
 	return nil, errors.Format("wrong connector type: %s", typ)
 }
 
-type directConnector struct{}
+type directConnector struct {
+	dns *resolver
+}
 
 func (c *directConnector) connect(w http.ResponseWriter, host string) error {
-	return protocol.Connect(w, host)
+	log.Printf("Connecting to %s", host)
+	srv, err := c.dns.dialContext(context.Background(), "tcp", host)
+	if err != nil {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return err
+	}
+	log.Printf("Connected to %s", host)
+	return protocol.Tunnel(w, srv)
 }
 
 type remoteConnector struct {
-	remote *url.URL
+	remotes *remoteSet
 }
 
 func (c *remoteConnector) connect(w http.ResponseWriter, host string) error {
+	remote, err := c.dial(context.Background(), host)
+	if err != nil {
+		if e, ok := err.(*remoteError); ok {
+			w.WriteHeader(e.status)
+		}
+		return err
+	}
+	log.Print("binding")
+	return protocol.Tunnel(w, remote)
+}
+
+// remoteError is an error response from the remote.
+type remoteError struct {
+	status int
+	err    error
+}
+
+func (e *remoteError) Error() string {
+	return e.err.Error()
+}
+
+// dial returns a connection to host through the remotes for host in turn
+// until one of them succeeds, or the error of the last one. A dial cancelled
+// by ctx is neither retried nor counted against the remote.
+func (c *remoteConnector) dial(ctx context.Context, host string) (io.ReadWriteCloser, error) {
+	var err error
+	for i, r := range c.remotes.candidatesFor(host) {
+		if i > 0 {
+			log.Printf("connect %s through remote %s instead", host, r.name)
+		}
+		var conn io.ReadWriteCloser
+		conn, err = c.dialVia(ctx, r, host)
+		if err != nil && ctx.Err() != nil {
+			return nil, err
+		}
+		status, cause := 0, err
+		if e, ok := err.(*remoteError); ok {
+			status, cause = e.status, nil
+		}
+		if !r.check(status, cause) {
+			return conn, err
+		}
+	}
+	return nil, err
+}
+
+// dialVia returns a connection to host through the remote, multiplexed if
+// possible. ctx cancels the dial, except opening a multiplexed stream.
+func (c *remoteConnector) dialVia(ctx context.Context, r *remoteServer, host string) (io.ReadWriteCloser, error) {
+	if r.mux != nil {
+		if conn, err := r.mux.dial(ctx, host); err != errMuxUnavailable {
+			return conn, err
+		}
+	}
+	if c.remotes.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.remotes.timeout)
+		defer cancel()
+	}
+	remote, resp, err := dialRemote(ctx, r.endpoint("c"), c.remotes.proxy, c.remotes.tls, c.remotes.key, http.Header{
+		"Connect-Host": []string{host},
+		//			"Connection":   []string{"Keep-Alive"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		remote.Close()
+		return nil, &remoteError{resp.StatusCode, errors.Format("error response from remote: %s", resp.Status)}
+	}
+	return remote, nil
+}
+
+// dialRemote connects to the remote through the upstream proxy if not nil, and
+// sends a GET request with header, until ctx is done. The returned connection
+// continues reading after the response.
+func dialRemote(ctx context.Context, u *url.URL, proxy *upstreamProxy, tlsConfig *tls.Config, key *protocol.Key, header http.Header) (net.Conn, *http.Response, error) {
 	var remote net.Conn
 	var err error
-	switch c.remote.Scheme {
+	switch u.Scheme {
 	case "https":
-		host := setDefaultPort(c.remote.Host, "443")
-		remote, err = tls.Dial("tcp", host, &tls.Config{InsecureSkipVerify: true})
+		remote, err = proxy.dialTLS(ctx, setDefaultPort(u.Host, "443"), tlsConfig)
 	case "http":
-		remote, err = net.Dial("tcp", setDefaultPort(c.remote.Host, "80"))
+		remote, err = proxy.dialContext(ctx, "tcp", setDefaultPort(u.Host, "80"))
 	default:
-		return errors.Format("invalid scheme for the remote %s", c.remote.String())
+		return nil, nil, errors.Format("invalid scheme for the remote %s", u.String())
 	}
 	if err != nil {
-		return errors.Wrap(err)
+		return nil, nil, errors.Wrap(err)
 	}
-	defer remote.Close()
 
-	if err := (&http.Request{
+	if header == nil {
+		header = make(http.Header)
+	}
+	req := &http.Request{
 		Method: "GET",
-		URL:    c.remote,
-		Header: http.Header{
-			"Connect-Host": []string{host},
-			//			"Connection":   []string{"Keep-Alive"},
-		},
-	}).Write(remote); err != nil {
-		return errors.Wrap(err)
+		URL:    u,
+		Header: header,
 	}
-	resp, err := http.ReadResponse(bufio.NewReader(remote), nil)
-	if err != nil {
-		return errors.Wrap(err)
+	if key != nil {
+		if err := key.Sign(req); err != nil {
+			remote.Close()
+			return nil, nil, err
+		}
 	}
-	if resp.StatusCode != http.StatusOK {
-		w.WriteHeader(resp.StatusCode)
-		return errors.Format("error response from remote: %s", resp.Status)
+	stop := interruptOnDone(ctx, remote)
+	r := bufio.NewReader(remote)
+	err = req.Write(remote)
+	var resp *http.Response
+	if err == nil {
+		resp, err = http.ReadResponse(r, nil)
+	}
+	stop()
+	if err == nil {
+		err = ctx.Err()
 	}
-	cli, err := protocol.Hijack(w)
 	if err != nil {
-		return err
+		remote.Close()
+		return nil, nil, errors.Wrap(err)
 	}
-	defer cli.Close()
-	if err := protocol.OK200(cli); err != nil {
-		return err
+	return &bufConn{remote, r}, resp, nil
+}
+
+// interruptOnDone makes the pending I/O of conn fail when ctx is done, until
+// the returned function is called. ctx is checked after that, because the
+// deadline of conn may have been set.
+func interruptOnDone(ctx context.Context, conn net.Conn) (stop func()) {
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
 	}
-	log.Print("binding")
-	return protocol.Bind(cli, remote)
 }
+
+// bufConn reads the data already buffered when reading the response.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
 func setDefaultPort(hostPort, defaultPort string) string {
 	host, port, _ := net.SplitHostPort(hostPort)
 	if host == "" {
@@ -110,35 +234,151 @@ func setDefaultPort(hostPort, defaultPort string) string {
 	return net.JoinHostPort(host, port)
 }
 
+const directDialTimeout = 15 * time.Second
+
 type smartConnector struct {
-	direct directConnector
-	remote remoteConnector
-	list   *blockList
+	direct    directConnector
+	remote    remoteConnector
+	list      *blockList
+	raceDelay time.Duration
 }
 
-func newSmartConnector(remote *url.URL, blockList *blockList) *smartConnector {
+func newSmartConnector(remotes *remoteSet, blockList *blockList, dns *resolver, raceDelay time.Duration) *smartConnector {
 	return &smartConnector{
-		directConnector{},
-		remoteConnector{remote},
+		directConnector{dns},
+		remoteConnector{remotes},
 		blockList,
+		raceDelay,
 	}
 }
 
 func (c *smartConnector) connect(w http.ResponseWriter, hostPort string) error {
-	host := trimPort(hostPort)
-	if c.list.has(host) {
+	switch c.list.routeHost(connectURL(hostPort)) {
+	case routeRemote:
 		return c.remote.connect(w, hostPort)
+	case routeDirect:
+		return c.direct.connect(w, hostPort)
 	}
-	if err := c.direct.connect(w, hostPort); err == nil {
-		return nil
-	}
-	if err := c.remote.connect(w, hostPort); err != nil {
+	srv, isRemote, err := c.race(hostPort)
+	if err != nil {
+		if e, ok := err.(*remoteError); ok {
+			w.WriteHeader(e.status)
+		} else {
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}
 		return err
 	}
-	if err := c.list.add(host); err != nil {
+	if isRemote {
+		return protocol.Tunnel(w, srv)
+	}
+	counter := &countingConn{Conn: srv.(net.Conn)}
+	err = protocol.Tunnel(w, counter)
+	if err != nil && counter.n == 0 {
+		// the tunnel is already confirmed so it is too late to fall back to
+		// the remote, but the next connection will go remotely if the server
+		// is cut off before it says anything, e.g. reset after SNI.
+		if class := classifyFailure(c.direct.dns, hostPort, err); class == failureReset {
+			c.learn(hostPort, class, err)
+		}
+	}
+	return err
+}
+
+type dialResult struct {
+	conn   io.ReadWriteCloser
+	err    error
+	remote bool
+}
+
+// race dials hostPort directly, and through the remote if the direct dial
+// fails or has not completed after raceDelay. The first successful connection
+// wins and the other is cancelled or closed. If raceDelay is not positive, the
+// remote is only tried after the direct dial fails.
+func (c *smartConnector) race(hostPort string) (io.ReadWriteCloser, bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	results := make(chan dialResult, 2)
+	go func() {
+		conn, err := c.direct.dns.dialContext(ctx, "tcp", hostPort)
+		results <- dialResult{conn, err, false}
+	}()
+	pending, remoteStarted := 1, false
+	startRemote := func() {
+		pending++
+		remoteStarted = true
+		go func() {
+			conn, err := c.remote.dial(ctx, hostPort)
+			results <- dialResult{conn, err, true}
+		}()
+	}
+	var timeout <-chan time.Time
+	if c.raceDelay > 0 {
+		timer := time.NewTimer(c.raceDelay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var directErr, remoteErr error
+	directDone := false
+	for pending > 0 {
+		select {
+		case <-timeout:
+			if !remoteStarted {
+				log.Printf("%s: direct dial is slow, racing with the remote", hostPort)
+				startRemote()
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				learn := r.remote && !directDone
+				if !learn {
+					cancel()
+				}
+				// a direct dial still pending after the remote wins is left
+				// to finish, so that its failure can be learned
+				go c.drain(hostPort, results, pending, learn, cancel)
+				if r.remote && directDone {
+					c.learn(hostPort, classifyFailure(c.direct.dns, hostPort, directErr), directErr)
+				}
+				return r.conn, r.remote, nil
+			}
+			if r.remote {
+				remoteErr = r.err
+				continue
+			}
+			directErr, directDone = r.err, true
+			if !remoteStarted {
+				startRemote()
+			}
+		}
+	}
+	cancel()
+	log.Printf("%s: direct dial failed: %v", hostPort, directErr)
+	return nil, false, remoteErr
+}
+
+// drain closes the connections of the losers of a race, and learns from a
+// losing direct dial if it fails.
+func (c *smartConnector) drain(hostPort string, results chan dialResult, pending int, learn bool, cancel context.CancelFunc) {
+	defer cancel()
+	for ; pending > 0; pending-- {
+		r := <-results
+		if r.conn != nil {
+			r.conn.Close()
+		}
+		if learn && !r.remote && r.err != nil {
+			c.learn(hostPort, classifyFailure(c.direct.dns, hostPort, r.err), r.err)
+		}
+	}
+}
+
+func (c *smartConnector) learn(hostPort string, class failureClass, cause error) {
+	if !class.interference() {
+		log.Printf("%s: direct connection failed (%s), not learned: %s", hostPort, class, cause.Error())
+		return
+	}
+	if err := c.list.add(hostPort, class, cause.Error()); err != nil {
 		log.Printf("fail to write list file: %s", err.Error())
 	}
-	return nil
 }
 
 type fakeTLSConnector struct {
@@ -195,6 +435,15 @@ func (f *fakeTLSConnector) connect(w http.ResponseWriter, host string) error {
 	log.Printf("all done: %v", req.URL)
 	return nil
 }
+
+// connectURL returns the URL used to match rules against a CONNECT target.
+func connectURL(hostPort string) *url.URL {
+	if host, port, err := net.SplitHostPort(hostPort); err == nil && port == "443" {
+		return &url.URL{Scheme: "https", Host: host}
+	}
+	return &url.URL{Scheme: "https", Host: hostPort}
+}
+
 func trimPort(hostPort string) string {
 	host, _, _ := net.SplitHostPort(hostPort)
 	return host
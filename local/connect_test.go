@@ -0,0 +1,162 @@
+package local
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := newBlockList(path.Join(dir, "blocklist"), path.Join(dir, "directlist"), path.Join(dir, "rules"), path.Join(dir, "countries"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := fakeConnectRemote(t)
+	defer remote.Close()
+	c := newSmartConnector(testRemoteSet(&url.URL{Scheme: "http", Host: remote.Addr().String()}), l, newResolver(nil), 50*time.Millisecond)
+
+	// direct succeeds
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	conn, isRemote, err := c.race(ln.Addr().String())
+	if err != nil || isRemote {
+		t.Fatalf("expect direct to win, got remote=%v, err=%v", isRemote, err)
+	}
+	conn.Close()
+
+	// direct refused, remote wins without learning
+	ln.Close()
+	conn, isRemote, err = c.race(ln.Addr().String())
+	if err != nil || !isRemote {
+		t.Fatalf("expect remote to win, got remote=%v, err=%v", isRemote, err)
+	}
+	conn.Close()
+	if r, _ := l.routeLocked("127.0.0.1"); r != routeSmart {
+		t.Fatalf("refused host should not be learned, got %v", r)
+	}
+
+	// direct blackholed, remote wins after the delay and the direct dial
+	// timing out is learned
+	blackhole, closed := fakeSlowProxy(t, -1)
+	defer blackhole.Close()
+	dns := newResolver(nil)
+	dns.proxy, _ = parseUpstreamProxy("http://" + blackhole.Addr().String())
+	dns.dialTimeout = 200 * time.Millisecond
+	c.direct.dns = dns
+	start := time.Now()
+	conn, isRemote, err = c.race("127.0.0.2:443")
+	if err != nil || !isRemote {
+		t.Fatalf("expect remote to win, got remote=%v, err=%v", isRemote, err)
+	}
+	if d := time.Since(start); d < c.raceDelay || d > dns.dialTimeout {
+		t.Fatalf("expect remote to win after the delay, got %v", d)
+	}
+	conn.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expect the direct dial abandoned after its timeout")
+	}
+	for deadline := time.Now().Add(time.Second); l.route(&url.URL{Host: "127.0.0.2"}) != routeRemote; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expect the blackholed host learned as blocked")
+		}
+	}
+	l.mu.Lock()
+	entry := l.entries["127.0.0.2"]
+	l.mu.Unlock()
+	if entry == nil || entry.Class != string(failureTimeout) {
+		t.Fatalf("expect a timeout entry, got %+v", entry)
+	}
+
+	// direct slower than the delay still wins, and the remote dial hanging
+	// is cancelled without counting against the remote
+	slowDirect, _ := fakeSlowProxy(t, 100*time.Millisecond)
+	defer slowDirect.Close()
+	hangingRemote, remoteClosed := fakeSlowProxy(t, -1)
+	defer hangingRemote.Close()
+	dns = newResolver(nil)
+	dns.proxy, _ = parseUpstreamProxy("http://" + slowDirect.Addr().String())
+	c.direct.dns = dns
+	c.remote.remotes = testRemoteSet(&url.URL{Scheme: "http", Host: hangingRemote.Addr().String()})
+	conn, isRemote, err = c.race("127.0.0.3:443")
+	if err != nil || isRemote {
+		t.Fatalf("expect direct to win, got remote=%v, err=%v", isRemote, err)
+	}
+	conn.Close()
+	select {
+	case <-remoteClosed:
+	case <-time.After(time.Second):
+		t.Fatal("expect the remote dial cancelled")
+	}
+	if c.remote.remotes.candidates()[0].isDown() {
+		t.Fatal("expect a cancelled dial not counted against the remote")
+	}
+}
+
+// fakeSlowProxy answers CONNECT requests after delay, or never if delay is
+// negative, and tells when a client closes its connection.
+func fakeSlowProxy(t *testing.T, delay time.Duration) (net.Listener, <-chan struct{}) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				if delay >= 0 {
+					time.Sleep(delay)
+					conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+				}
+				ioutil.ReadAll(conn)
+				closed <- struct{}{}
+			}()
+		}
+	}()
+	return ln, closed
+}
+
+// fakeConnectRemote accepts any tunnel request.
+func fakeConnectRemote(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+				conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+	return ln
+}
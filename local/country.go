@@ -0,0 +1,137 @@
+package local
+
+import (
+	"bufio"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"h12.io/egress/geoip"
+	"h12.io/errors"
+)
+
+// countryPolicy routes a host by the countries of its addresses, looked up in
+// the default GeoIP database. A host is routed remotely if any of its
+// addresses is in a remote country, or directly if all of them are in direct
+// countries, or smartly otherwise.
+type countryPolicy struct {
+	direct map[string]bool
+	remote map[string]bool
+}
+
+// defaultCountryPolicy routes hosts in China directly.
+func defaultCountryPolicy() *countryPolicy {
+	return &countryPolicy{
+		direct: map[string]bool{"CN": true},
+		remote: make(map[string]bool),
+	}
+}
+
+// loadCountryPolicy reads a country policy file, or returns the default policy
+// if the file does not exist. Each non-empty line not starting with # is one
+// of:
+//     direct <ISO country code>...
+//     remote <ISO country code>...
+// A file without direct lines routes no country directly.
+func loadCountryPolicy(file string) (*countryPolicy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return defaultCountryPolicy(), nil
+		}
+		return nil, errors.Wrap(err)
+	}
+	defer f.Close()
+	p := &countryPolicy{
+		direct: make(map[string]bool),
+		remote: make(map[string]bool),
+	}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		var set map[string]bool
+		switch fields[0] {
+		case "direct":
+			set = p.direct
+		case "remote":
+			set = p.remote
+		default:
+			return nil, errors.Format("%s:%d: expect direct or remote: %s", file, lineNum, line)
+		}
+		if len(fields) < 2 {
+			return nil, errors.Format("%s:%d: missing country code: %s", file, lineNum, line)
+		}
+		for _, code := range fields[1:] {
+			code = strings.ToUpper(code)
+			if len(code) != 2 {
+				return nil, errors.Format("%s:%d: invalid country code %s", file, lineNum, code)
+			}
+			set[code] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	for code := range p.direct {
+		if p.remote[code] {
+			return nil, errors.Format("%s: country %s is both direct and remote", file, code)
+		}
+	}
+	return p, nil
+}
+
+func (p *countryPolicy) route(ips []net.IP) route {
+	if len(ips) == 0 {
+		return routeSmart
+	}
+	db := geoip.Default()
+	direct := true
+	for _, ip := range ips {
+		country := db.Lookup(ip)
+		if p.remote[country] {
+			return routeRemote
+		}
+		if !p.direct[country] {
+			direct = false
+		}
+	}
+	if direct {
+		return routeDirect
+	}
+	return routeSmart
+}
+
+// routeCountry returns the route of host by the countries of its trusted
+// addresses, or routeSmart if it cannot be resolved.
+func (l *blockList) routeCountry(host string) route {
+	countries := l.countryPolicy()
+	if len(countries.direct) == 0 && len(countries.remote) == 0 {
+		return routeSmart
+	}
+	return countries.route(l.lookupIP(normalizeHost(host)))
+}
+
+// routeIPs returns the route of addresses by their countries.
+func (l *blockList) routeIPs(ips []net.IP) route {
+	return l.countryPolicy().route(ips)
+}
+
+func (l *blockList) countryPolicy() *countryPolicy {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.countries
+}
+
+// routeHost returns the route of u by the rules, and then by the countries of
+// its host if the rules leave it to the smart route.
+func (l *blockList) routeHost(u *url.URL) route {
+	if r := l.route(u); r != routeSmart {
+		return r
+	}
+	return l.routeCountry(u.Hostname())
+}
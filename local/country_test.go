@@ -0,0 +1,69 @@
+package local
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLoadCountryPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "country")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "countries")
+
+	p, err := loadCountryPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.direct["CN"] || len(p.direct) != 1 || len(p.remote) != 0 {
+		t.Fatalf("expect the default policy, got %v", p)
+	}
+
+	ioutil.WriteFile(file, []byte("# comment\ndirect cn hk\n\nremote US\n"), 0600)
+	p, err = loadCountryPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.direct["CN"] || !p.direct["HK"] || !p.remote["US"] || len(p.direct) != 2 || len(p.remote) != 1 {
+		t.Fatalf("wrong policy %v", p)
+	}
+
+	for _, content := range []string{
+		"proxy US\n",
+		"direct\n",
+		"direct CHN\n",
+		"direct CN\nremote CN\n",
+	} {
+		ioutil.WriteFile(file, []byte(content), 0600)
+		if _, err := loadCountryPolicy(file); err == nil {
+			t.Fatalf("expect error for %q", content)
+		}
+	}
+}
+
+func TestCountryRoute(t *testing.T) {
+	for _, testcase := range []struct {
+		policy   *countryPolicy
+		ips      []string
+		expected route
+	}{
+		{defaultCountryPolicy(), nil, routeSmart},
+		{defaultCountryPolicy(), []string{"1.2.4.8", "240e::1"}, routeDirect},
+		{defaultCountryPolicy(), []string{"1.2.4.8", "8.8.8.8"}, routeSmart},
+		{&countryPolicy{remote: map[string]bool{"CN": true}}, []string{"8.8.8.8", "1.2.4.8"}, routeRemote},
+		{&countryPolicy{remote: map[string]bool{"CN": true}}, []string{"8.8.8.8"}, routeSmart},
+	} {
+		var ips []net.IP
+		for _, s := range testcase.ips {
+			ips = append(ips, net.ParseIP(s))
+		}
+		if r := testcase.policy.route(ips); r != testcase.expected {
+			t.Fatalf("expect %v for %v, got %v", testcase.expected, testcase.ips, r)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package local
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"h12.io/egress/geoip"
+	"h12.io/egress/protocol"
+	"h12.io/errors"
+)
+
+const (
+	dnsMinTTL     = time.Minute
+	dnsMaxTTL     = time.Hour
+	dnsTimeout    = 5 * time.Second
+	dnsRetryDelay = 5 * time.Minute
+)
+
+// resolver resolves host names with DNS-over-HTTPS through the remotes, which
+// cannot be forged on the way, and with the local resolver at the same time to
+// detect forged answers. Trusted answers are cached for their TTL. A nil
+// resolver, or one whose remotes are unavailable, uses the local answers only.
+type resolver struct {
+	remotes     *remoteSet
+	proxy       *upstreamProxy // for direct connections
+	countries   *countryPolicy // to tell forged local answers, the default if nil
+	dialTimeout time.Duration
+	cache       map[string]*dnsAnswer
+	retryAt     time.Time
+	mu          sync.Mutex
+}
+
+// dnsAnswer is the result of resolving a host.
+type dnsAnswer struct {
+	ips      []net.IP // addresses to dial
+	local    []net.IP // answers of the local resolver
+	trusted  bool     // ips are resolved through the remote
+	poisoned bool     // local answers are forged
+	expires  time.Time
+}
+
+// newResolver returns a resolver using the remotes, or the local resolver only
+// if remotes is nil.
+func newResolver(remotes *remoteSet) *resolver {
+	return &resolver{
+		remotes:     remotes,
+		cache:       make(map[string]*dnsAnswer),
+		dialTimeout: directDialTimeout,
+	}
+}
+
+// lookup resolves host with the system resolver as the local resolver.
+func (r *resolver) lookup(ctx context.Context, host string) (*dnsAnswer, error) {
+	return r.lookupWith(ctx, net.DefaultResolver, host)
+}
+
+// lookupWith resolves host with localResolver as the local resolver. The local
+// answers are considered forged if they contain a known forged address, or if
+// they have nothing in common with the trusted answers and are neither all
+// private nor all in the direct countries. The latter may also happen to a
+// CDN, but then the trusted answers work equally well. The local answers are
+// used if there is no trusted answer.
+func (r *resolver) lookupWith(ctx context.Context, localResolver *net.Resolver, host string) (*dnsAnswer, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return &dnsAnswer{ips: []net.IP{ip}, trusted: true}, nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if a := r.cached(host); a != nil {
+		return a, nil
+	}
+
+	type localResult struct {
+		ips []net.IP
+		err error
+	}
+	localc := make(chan localResult, 1)
+	go func() {
+		ips, err := lookupLocal(ctx, localResolver, host)
+		localc <- localResult{ips, err}
+	}()
+	trusted, ttl, trustedErr := r.lookupRemote(ctx, host)
+	local := <-localc
+
+	if trustedErr != nil {
+		if trustedErr != errDNSUnavailable {
+			log.Printf("fail to resolve %s through the remote: %s", host, trustedErr.Error())
+		}
+		if local.err != nil {
+			return nil, local.err
+		}
+		return &dnsAnswer{
+			ips:      local.ips,
+			local:    local.ips,
+			poisoned: isPoisoned(host, local.ips),
+		}, nil
+	}
+	a := &dnsAnswer{
+		ips:      trusted,
+		local:    local.ips,
+		trusted:  true,
+		poisoned: isPoisoned(host, local.ips) || r.forgedByCountry(local.ips, trusted),
+		expires:  time.Now().Add(ttl),
+	}
+	if len(trusted) == 0 {
+		// a name only the local resolver knows, e.g. from the hosts file or
+		// an intranet DNS server
+		if len(local.ips) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		a.ips, a.trusted = local.ips, false
+	}
+	if a.poisoned {
+		log.Printf("DNS answers for %s are forged: %v, trusted answers: %v", host, local.ips, trusted)
+	}
+	r.mu.Lock()
+	r.cache[host] = a
+	r.mu.Unlock()
+	return a, nil
+}
+
+func (r *resolver) cached(host string) *dnsAnswer {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a := r.cache[host]
+	if a == nil {
+		return nil
+	}
+	if time.Now().After(a.expires) {
+		delete(r.cache, host)
+		return nil
+	}
+	return a
+}
+
+func lookupLocal(ctx context.Context, localResolver *net.Resolver, host string) ([]net.IP, error) {
+	addrs, err := localResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i := range addrs {
+		ips[i] = addrs[i].IP
+	}
+	return ips, nil
+}
+
+var errDNSUnavailable = errors.New("DNS through the remote is unavailable")
+
+// lookupRemote resolves the IPv4 and IPv6 addresses of host through the
+// remote, returning the shortest TTL of the answers. When the remote fails,
+// errDNSUnavailable is returned without retrying for a while.
+func (r *resolver) lookupRemote(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if r == nil || r.remotes == nil {
+		return nil, 0, errDNSUnavailable
+	}
+	r.mu.Lock()
+	retryAt := r.retryAt
+	r.mu.Unlock()
+	if time.Now().Before(retryAt) {
+		return nil, 0, errDNSUnavailable
+	}
+
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	results := make(chan result, 2)
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func(typ dnsmessage.Type) {
+			ips, ttl, err := r.exchange(ctx, host, typ)
+			results <- result{ips, ttl, err}
+		}(typ)
+	}
+	var ips []net.IP
+	ttl := dnsMaxTTL
+	var err error
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.err != nil {
+			err = res.err
+			continue
+		}
+		ips = append(ips, res.ips...)
+		if res.ttl < ttl {
+			ttl = res.ttl
+		}
+	}
+	if err != nil {
+		if _, ok := err.(*dnsError); ok {
+			return nil, 0, err
+		}
+		log.Printf("fail to resolve through the remote, retry after %v: %s", dnsRetryDelay, err.Error())
+		r.mu.Lock()
+		r.retryAt = time.Now().Add(dnsRetryDelay)
+		r.mu.Unlock()
+		return nil, 0, errDNSUnavailable
+	}
+	if ttl < dnsMinTTL {
+		ttl = dnsMinTTL
+	}
+	return ips, ttl, nil
+}
+
+// dnsError is an error answer from the trusted resolver other than NXDOMAIN.
+type dnsError struct {
+	host  string
+	rcode dnsmessage.RCode
+}
+
+func (e *dnsError) Error() string {
+	return "DNS error for " + e.host + ": " + e.rcode.String()
+}
+
+// exchange sends a query of type typ for host to the remote and returns the
+// addresses in the answer, which is empty if host does not exist.
+func (r *resolver) exchange(ctx context.Context, host string, typ dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, errors.Wrap(err)
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, errors.Wrap(err)
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: typ, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, errors.Wrap(err)
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return nil, 0, errors.Wrap(err)
+	}
+	answer, err := r.forward(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseDNSAnswer(host, answer)
+}
+
+// forward sends the DNS query in wire format to the remotes in turn and
+// returns the first answer.
+func (r *resolver) forward(ctx context.Context, query []byte) ([]byte, error) {
+	if r == nil || r.remotes == nil {
+		return nil, errDNSUnavailable
+	}
+	err := errDNSUnavailable
+	for _, remote := range r.remotes.candidates() {
+		var answer []byte
+		var status int
+		answer, status, err = r.forwardTo(ctx, remote, query)
+		if err != nil && ctx.Err() != nil {
+			return nil, err
+		}
+		retry := remote.check(status, err)
+		if err == nil && status != http.StatusOK {
+			err = errors.Format("error response from remote %s: %d", remote.name, status)
+		}
+		if !retry {
+			return answer, err
+		}
+	}
+	return nil, err
+}
+
+// forwardTo sends the DNS query to a remote, and returns the answer, or the
+// status of an error response.
+func (r *resolver) forwardTo(ctx context.Context, remote *remoteServer, query []byte) ([]byte, int, error) {
+	req, err := protocol.MarshalDNSQuery(query, remote.endpoint("d").String())
+	if err != nil {
+		return nil, 0, err
+	}
+	if key := r.remotes.key; key != nil {
+		if err := key.Sign(req); err != nil {
+			return nil, 0, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	resp, err := r.remotes.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, errors.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, nil
+	}
+	answer, err := protocol.UnmarshalDNSAnswer(resp)
+	return answer, resp.StatusCode, err
+}
+
+// parseDNSAnswer returns the A and AAAA records in msg and their shortest TTL.
+func parseDNSAnswer(host string, msg []byte) ([]net.IP, time.Duration, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, 0, errors.Wrap(err)
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, dnsMinTTL, nil
+	default:
+		return nil, 0, &dnsError{host, h.RCode}
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, errors.Wrap(err)
+	}
+	var ips []net.IP
+	ttl := dnsMaxTTL
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, errors.Wrap(err)
+		}
+		switch ah.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, errors.Wrap(err)
+			}
+			ips = append(ips, net.IP(r.A[:]))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, errors.Wrap(err)
+			}
+			ips = append(ips, net.IP(r.AAAA[:]))
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, errors.Wrap(err)
+			}
+			continue
+		}
+		if d := time.Duration(ah.TTL) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	return ips, ttl, nil
+}
+
+// disjoint returns true if neither list is empty and they have no address in
+// common.
+func disjoint(a, b []net.IP) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+	for _, x := range a {
+		for _, y := range b {
+			if x.Equal(y) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// forgedByCountry returns true if the local answers have nothing in common
+// with the trusted answers and are neither all private nor all in the direct
+// countries. IPv6 answers are left out with the embedded GeoIP database,
+// whose IPv6 ranges are incomplete.
+func (r *resolver) forgedByCountry(local, trusted []net.IP) bool {
+	if geoip.Default() == geoip.Embedded {
+		var v4 []net.IP
+		for _, ip := range local {
+			if ip.To4() != nil {
+				v4 = append(v4, ip)
+			}
+		}
+		local = v4
+	}
+	return disjoint(local, trusted) && !allPrivate(local) && r.countryPolicy().route(local) != routeDirect
+}
+
+// allPrivate returns true if ips are all loopback, private or link-local
+// addresses, which are only meaningful to the local network, so that they
+// differ from the public answers without being forged.
+func allPrivate(ips []net.IP) bool {
+	for _, ip := range ips {
+		if !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() {
+			return false
+		}
+	}
+	return len(ips) > 0
+}
+
+// countryPolicy returns the country policy of the configuration, or the
+// default one if not set.
+func (r *resolver) countryPolicy() *countryPolicy {
+	if r == nil || r.countries == nil {
+		return defaultCountryPolicy()
+	}
+	return r.countries
+}
+
+// dial resolves host and dials the answers in turn. Forged local answers fail
+// early unless trusted answers are available; otherwise a failure to dial the
+// trusted answers of a host with forged local answers is reported as
+// poisoning.
+func (r *resolver) dial(ctx context.Context, hostPort string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	if r != nil && r.proxy != nil {
+		// the host is resolved by the proxy
+		return r.proxy.dial(ctx, hostPort, timeout)
+	}
+	a, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if a.poisoned && !a.trusted {
+		return nil, &poisonedError{host, a.local, nil}
+	}
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	for _, ip := range a.ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	if a.poisoned {
+		return nil, &poisonedError{host, a.local, err}
+	}
+	return nil, err
+}
+
+// dialContext dials addr with the dial timeout of the resolver. It is also the
+// DialContext of an http.Transport for direct fetching.
+func (r *resolver) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	timeout := directDialTimeout
+	if r != nil {
+		timeout = r.dialTimeout
+	}
+	return r.dial(ctx, addr, timeout)
+}
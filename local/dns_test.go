@@ -0,0 +1,169 @@
+package local
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"h12.io/egress/protocol"
+)
+
+func TestResolver(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	for _, testcase := range []struct {
+		answer  string // of the remote, none if empty
+		trusted bool
+	}{
+		{"127.0.0.1", true},
+		{"", false}, // only in the hosts file
+	} {
+		var queries int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&queries, 1)
+			query, err := protocol.UnmarshalDNSQuery(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			var ips []net.IP
+			if testcase.answer != "" {
+				ips = append(ips, net.ParseIP(testcase.answer))
+			}
+			answer, err := fakeDNSAnswer(query, ips...)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			protocol.MarshalDNSAnswer(answer, w)
+		}))
+		u, _ := url.Parse(srv.URL)
+		r := newResolver(testRemoteSet(u))
+
+		a, err := r.lookup(context.Background(), "localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.trusted != testcase.trusted || a.poisoned || len(a.ips) == 0 ||
+			(testcase.trusted && a.ips[0].String() != testcase.answer) {
+			t.Fatalf("wrong answer for %q: %v, trusted %v, poisoned %v", testcase.answer, a.ips, a.trusted, a.poisoned)
+		}
+		r.lookup(context.Background(), "localhost")
+		if n := atomic.LoadInt32(&queries); n != 2 { // A and AAAA
+			t.Fatalf("expect the answer cached, got %d queries", n)
+		}
+
+		conn, err := r.dial(context.Background(), net.JoinHostPort("localhost", port), directDialTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		srv.Close()
+	}
+}
+
+func fakeDNSAnswer(query []byte, ips ...net.IP) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	h.Response = true
+	b := dnsmessage.NewBuilder(nil, h)
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	for _, ip := range ips {
+		if q.Type == dnsmessage.TypeA && ip.To4() != nil {
+			var a dnsmessage.AResource
+			copy(a.A[:], ip.To4())
+			b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: 300}, a)
+		}
+	}
+	return b.Finish()
+}
+
+func TestForgedByCountry(t *testing.T) {
+	trusted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, err := protocol.UnmarshalDNSQuery(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		answer, _ := fakeDNSAnswer(query, net.ParseIP("8.8.8.8"))
+		protocol.MarshalDNSAnswer(answer, w)
+	}))
+	defer trusted.Close()
+	upstream := fakeDNSUpstream(t, map[string][]string{"cdn.example.": {"1.2.4.8"}, "intranet.example.": {"10.1.2.3"}})
+	defer upstream.Close()
+	local := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return net.Dial("udp", upstream.LocalAddr().String())
+		},
+	}
+	u, _ := url.Parse(trusted.URL)
+
+	for _, testcase := range []struct {
+		countries *countryPolicy
+		poisoned  bool
+	}{
+		{nil, false}, // CN by default
+		{&countryPolicy{direct: map[string]bool{"US": true}}, true},
+		{&countryPolicy{}, true},
+	} {
+		r := newResolver(testRemoteSet(u))
+		r.countries = testcase.countries
+		a, err := r.lookupWith(context.Background(), local, "cdn.example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.poisoned != testcase.poisoned {
+			t.Fatalf("expect poisoned %v with %v, got %v", testcase.poisoned, testcase.countries, a.poisoned)
+		}
+	}
+
+	// split-horizon DNS of an intranet
+	r := newResolver(testRemoteSet(u))
+	r.countries = &countryPolicy{}
+	a, err := r.lookupWith(context.Background(), local, "intranet.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.poisoned || !a.ips[0].Equal(net.ParseIP("8.8.8.8")) {
+		t.Fatalf("expect private local answers not forged, got %v, poisoned %v", a.ips, a.poisoned)
+	}
+
+	// IPv6 answers are not judged by the incomplete IPv6 ranges of the
+	// embedded GeoIP database
+	trustedIPs := []net.IP{net.ParseIP("8.8.8.8")}
+	if r.forgedByCountry([]net.IP{net.ParseIP("2402:f000::1")}, trustedIPs) {
+		t.Fatal("expect an IPv6 answer not forged by country")
+	}
+	if !r.forgedByCountry([]net.IP{net.ParseIP("9.9.9.9"), net.ParseIP("2402:f000::1")}, trustedIPs) {
+		t.Fatal("expect an IPv4 answer still forged by country")
+	}
+}
@@ -0,0 +1,283 @@
+package local
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"h12.io/errors"
+)
+
+const (
+	dnsUDPSize     = 512
+	dnsIdleTimeout = 10 * time.Second
+)
+
+// dnsServer answers DNS queries by the routing of the block list: domains
+// routed directly get the answers of the upstream resolver, blocked domains
+// get the trusted answers through the remote, and other domains get the
+// upstream answers only if they are not forged and in the direct countries,
+// so that apps resolving names by themselves are neither poisoned nor sent to
+// far away servers of a CDN.
+type dnsServer struct {
+	list     *blockList
+	upstream string
+	local    *net.Resolver
+}
+
+// ServeDNS answers DNS queries on addr over both UDP and TCP. upstream is the
+// address of the DNS server for direct domains, or the system resolver is used
+// if it is empty, which must not point back to addr.
+func (e *Egress) ServeDNS(addr, upstream string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return errors.Wrap(err)
+	}
+	return newDNSServer(e.list, upstream).serve(pc, ln)
+}
+
+func newDNSServer(list *blockList, upstream string) *dnsServer {
+	s := &dnsServer{
+		list:     list,
+		upstream: upstream,
+		local:    net.DefaultResolver,
+	}
+	if upstream != "" {
+		s.local = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, upstream)
+			},
+		}
+	}
+	return s
+}
+
+func (s *dnsServer) serve(pc net.PacketConn, ln net.Listener) error {
+	defer pc.Close()
+	defer ln.Close()
+	errc := make(chan error, 2)
+	go func() { errc <- s.serveUDP(pc) }()
+	go func() { errc <- s.serveTCP(ln) }()
+	return <-errc
+}
+
+func (s *dnsServer) serveUDP(pc net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if answer := s.answer(query, "udp"); answer != nil {
+				pc.WriteTo(answer, addr)
+			}
+		}()
+	}
+}
+
+func (s *dnsServer) serveTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(dnsIdleTimeout))
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				answer := s.answer(query, "tcp")
+				if answer == nil {
+					return
+				}
+				if err := writeTCPMessage(conn, answer); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// answer returns the answer to the query in wire format, or nil if the query
+// cannot be parsed.
+func (s *dnsServer) answer(query []byte, network string) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		answer, _ := dnsResponse(h, nil, dnsmessage.RCodeFormatError, nil, 0)
+		return answer
+	}
+	host := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	ctx, cancel := context.WithTimeout(context.Background(), 2*dnsTimeout)
+	defer cancel()
+
+	if q.Class != dnsmessage.ClassINET || (q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA) {
+		answer, err := s.forward(ctx, host, query, network)
+		if err != nil {
+			log.Printf("fail to resolve %s %s: %s", host, q.Type, err.Error())
+			answer, _ = dnsResponse(h, &q, dnsmessage.RCodeServerFailure, nil, 0)
+		}
+		return answer
+	}
+
+	rcode := dnsmessage.RCodeSuccess
+	ips, ttl, err := s.resolve(ctx, host)
+	if err != nil {
+		rcode = dnsmessage.RCodeServerFailure
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			rcode = dnsmessage.RCodeNameError
+		} else {
+			log.Printf("fail to resolve %s: %s", host, err.Error())
+		}
+	}
+	answer, err := dnsResponse(h, &q, rcode, ips, ttl)
+	if err != nil {
+		log.Printf("fail to build DNS answer for %s: %s", host, err.Error())
+		return nil
+	}
+	if network == "udp" && len(answer) > dnsUDPSize {
+		h.Truncated = true
+		answer, _ = dnsResponse(h, &q, rcode, nil, 0)
+	}
+	return answer
+}
+
+// resolve returns the addresses of host by the route of the host.
+func (s *dnsServer) resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	a, err := s.list.resolver().lookupWith(ctx, s.local, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	ttl := dnsMinTTL
+	if !a.expires.IsZero() {
+		if ttl = time.Until(a.expires); ttl < time.Second {
+			ttl = time.Second
+		}
+	}
+	if a.poisoned || len(a.local) == 0 {
+		return a.ips, ttl, nil
+	}
+	switch s.list.route(connectURL(host)) {
+	case routeDirect:
+		return a.local, ttl, nil
+	case routeSmart:
+		if s.list.routeIPs(a.local) == routeDirect {
+			return a.local, ttl, nil
+		}
+	}
+	return a.ips, ttl, nil
+}
+
+// forward forwards a query of a type other than A or AAAA through the remote
+// if host is blocked or no upstream is given, or to the upstream otherwise.
+func (s *dnsServer) forward(ctx context.Context, host string, query []byte, network string) ([]byte, error) {
+	if s.upstream == "" || s.list.route(connectURL(host)) == routeRemote {
+		return s.list.resolver().forward(ctx, query)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, s.upstream)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return buf[:n], nil
+}
+
+// dnsResponse returns a response to question q of the query with header h,
+// answered with the addresses of the queried type in ips.
+func dnsResponse(h dnsmessage.Header, q *dnsmessage.Question, rcode dnsmessage.RCode, ips []net.IP, ttl time.Duration) ([]byte, error) {
+	h.Response = true
+	h.Authoritative = false
+	h.RecursionAvailable = true
+	h.RCode = rcode
+	b := dnsmessage.NewBuilder(nil, h)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	if q == nil {
+		return b.Finish()
+	}
+	if err := b.Question(*q); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: uint32(ttl / time.Second)}
+	for _, ip := range ips {
+		ip4 := ip.To4()
+		switch {
+		case q.Type == dnsmessage.TypeA && ip4 != nil:
+			var r dnsmessage.AResource
+			copy(r.A[:], ip4)
+			if err := b.AResource(rh, r); err != nil {
+				return nil, errors.Wrap(err)
+			}
+		case q.Type == dnsmessage.TypeAAAA && ip4 == nil:
+			var r dnsmessage.AAAAResource
+			copy(r.AAAA[:], ip.To16())
+			if err := b.AAAAResource(rh, r); err != nil {
+				return nil, errors.Wrap(err)
+			}
+		}
+	}
+	return b.Finish()
+}
+
+// readTCPMessage reads a DNS message prefixed with its length.
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return errors.Wrap(err)
+}
@@ -0,0 +1,130 @@
+package local
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"h12.io/egress/protocol"
+)
+
+func TestDNSServer(t *testing.T) {
+	trusted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, err := protocol.UnmarshalDNSQuery(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		answer, _ := fakeDNSAnswer(query, net.ParseIP("8.8.8.8"))
+		protocol.MarshalDNSAnswer(answer, w)
+	}))
+	defer trusted.Close()
+	upstream := fakeDNSUpstream(t, map[string][]string{
+		"china.example.":       {"1.2.4.8"},
+		"foreign.example.":     {"93.46.8.89"},
+		"www.blocked.example.": {"1.2.4.8"},
+		"direct.example.":      {"1.2.4.8", "8.8.8.8"},
+		"smart.example.":       {"1.2.4.8", "8.8.8.8"},
+	})
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "dnsserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "blocklist"), []byte(".blocked.example\n"), 0600)
+	ioutil.WriteFile(path.Join(dir, "directlist"), []byte("direct.example\n"), 0600)
+	u, _ := url.Parse(trusted.URL)
+	dns := newResolver(testRemoteSet(u))
+	l, err := newBlockList(path.Join(dir, "blocklist"), path.Join(dir, "directlist"), path.Join(dir, "rules"), path.Join(dir, "countries"), dns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the TCP port may be taken although the UDP one is free
+	var pc net.PacketConn
+	var ln net.Listener
+	for i := 0; i < 10 && ln == nil; i++ {
+		pc, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ln, err = net.Listen("tcp", pc.LocalAddr().String()); err != nil {
+			pc.Close()
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	go newDNSServer(l, upstream.LocalAddr().String()).serve(pc, ln)
+
+	for _, network := range []string{"udp", "tcp"} {
+		client := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, pc.LocalAddr().String())
+			},
+		}
+		for host, expected := range map[string]string{
+			"china.example":       "1.2.4.8",
+			"foreign.example":     "8.8.8.8",
+			"www.blocked.example": "8.8.8.8",
+			"direct.example":      "1.2.4.8,8.8.8.8",
+			"smart.example":       "8.8.8.8",
+		} {
+			ips, err := client.LookupIP(context.Background(), "ip4", host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var actual []string
+			for _, ip := range ips {
+				actual = append(actual, ip.String())
+			}
+			if strings.Join(actual, ",") != expected {
+				t.Fatalf("%s %s: expect %s, got %v", network, host, expected, actual)
+			}
+		}
+	}
+}
+
+// fakeDNSUpstream answers A queries with the addresses in answers.
+func fakeDNSUpstream(t *testing.T, answers map[string][]string) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			if _, err := p.Start(buf[:n]); err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			var ips []net.IP
+			for _, s := range answers[q.Name.String()] {
+				ips = append(ips, net.ParseIP(s))
+			}
+			answer, _ := fakeDNSAnswer(buf[:n], ips...)
+			pc.WriteTo(answer, addr)
+		}
+	}()
+	return pc
+}
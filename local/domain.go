@@ -0,0 +1,192 @@
+package local
+
+import (
+	"net"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// domainTrie stores domain rules by reversed labels, e.g. "www.example.com"
+// is stored under com -> example -> www.
+//
+// A rule is one of:
+//     example.com      matches example.com only
+//     *.example.com    matches subdomains of example.com but not itself
+//     .example.com     matches example.com and its subdomains
+type domainTrie struct {
+	root domainNode
+}
+
+type domainNode struct {
+	children     map[string]*domainNode
+	exactRule    string // the rule matching the domain itself
+	wildcardRule string // the rule matching its subdomains
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{}
+}
+
+func parseDomainRule(rule string) (domain string, exact, wildcard bool) {
+	rule = strings.ToLower(strings.TrimSpace(rule))
+	exact, wildcard = true, false
+	switch {
+	case strings.HasPrefix(rule, "*."):
+		rule, exact, wildcard = rule[2:], false, true
+	case strings.HasPrefix(rule, "."):
+		rule, wildcard = rule[1:], true
+	}
+	return normalizeHost(rule), exact, wildcard
+}
+
+// canonicalRule returns the rule in the form kept by domainTrie.
+func canonicalRule(domain string, exact, wildcard bool) string {
+	switch {
+	case exact && wildcard:
+		return "." + domain
+	case wildcard:
+		return "*." + domain
+	}
+	return domain
+}
+
+func (t *domainTrie) node(domain string, create bool) *domainNode {
+	n := &t.root
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := n.children[labels[i]]
+		if !ok {
+			if !create {
+				return nil
+			}
+			if n.children == nil {
+				n.children = make(map[string]*domainNode)
+			}
+			child = &domainNode{}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	return n
+}
+
+// add inserts a rule and returns false if the rule is invalid or already
+// covered by existing rules for the same domain.
+func (t *domainTrie) add(rule string) bool {
+	domain, exact, wildcard := parseDomainRule(rule)
+	if domain == "" {
+		return false
+	}
+	rule = canonicalRule(domain, exact, wildcard)
+	n := t.node(domain, true)
+	added := false
+	if exact && n.exactRule == "" {
+		n.exactRule, added = rule, true
+	}
+	if wildcard && n.wildcardRule == "" {
+		n.wildcardRule, added = rule, true
+	}
+	return added
+}
+
+// remove deletes a rule added before and returns false if it is not found.
+func (t *domainTrie) remove(rule string) bool {
+	domain, exact, wildcard := parseDomainRule(rule)
+	rule = canonicalRule(domain, exact, wildcard)
+	n := t.node(domain, false)
+	if n == nil {
+		return false
+	}
+	removed := false
+	if n.exactRule == rule {
+		n.exactRule, removed = "", true
+	}
+	if n.wildcardRule == rule {
+		n.wildcardRule, removed = "", true
+	}
+	return removed
+}
+
+// match returns the specificity of the most specific rule matching host and
+// the rule, or 0 if none matches. A rule with more labels is more specific,
+// and an exact match is more specific than a wildcard match with the same
+// labels.
+func (t *domainTrie) match(host string) (int, string) {
+	host = normalizeHost(host)
+	if host == "" {
+		return 0, ""
+	}
+	best, rule := 0, ""
+	n := &t.root
+	labels := strings.Split(host, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		n = n.children[labels[i]]
+		if n == nil {
+			break
+		}
+		depth := len(labels) - i
+		if i == 0 && n.exactRule != "" {
+			best, rule = 2*depth+1, n.exactRule
+		} else if i > 0 && n.wildcardRule != "" {
+			best, rule = 2*depth, n.wildcardRule
+		}
+	}
+	return best, rule
+}
+
+// normalizeHost lower-cases host and strips the port and the trailing dot.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// siteRule returns the rule covering the whole site of host, e.g.
+// ".example.co.uk" for "www.example.co.uk". IP addresses and hosts without a
+// registrable domain are kept as they are.
+func siteRule(host string) string {
+	host = normalizeHost(host)
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	site, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return "." + site
+}
+
+const (
+	flagExact    = 1
+	flagWildcard = 2
+)
+
+// flags returns every domain with rules, mapped to flagExact, flagWildcard or
+// both.
+func (t *domainTrie) flags() map[string]int {
+	m := make(map[string]int)
+	var walk func(n *domainNode, domain string)
+	walk = func(n *domainNode, domain string) {
+		f := 0
+		if n.exactRule != "" {
+			f |= flagExact
+		}
+		if n.wildcardRule != "" {
+			f |= flagWildcard
+		}
+		if f != 0 {
+			m[domain] = f
+		}
+		for label, child := range n.children {
+			if domain == "" {
+				walk(child, label)
+			} else {
+				walk(child, label+"."+domain)
+			}
+		}
+	}
+	walk(&t.root, "")
+	return m
+}
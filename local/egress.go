@@ -5,44 +5,135 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"net/url"
-	"path"
-	"time"
+	"os"
+	"sync"
+	"sync/atomic"
 
+	"h12.io/egress/protocol"
 	"h12.io/errors"
 )
 
 type Egress struct {
-	fetcher
-	connector
+	state    atomic.Value // *egressState
+	list     *blockList   // kept across reloads
+	pac      *pacFile
+	maintain sync.Once
+	reloadMu sync.Mutex
 }
 
-func NewEgress(remote *url.URL, workDir, fetcherType, connectorType string) (*Egress, error) {
-	httpClient := &http.Client{
-		Transport: &http.Transport{
-			Dial: (&net.Dialer{
-				Timeout:   15 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).Dial,
-			TLSHandshakeTimeout: 15 * time.Second,
-		}}
-	blockList, err := newBlockList(path.Join(workDir, "blocklist"))
+// NewEgress returns the local egress of the configuration.
+func NewEgress(cfg *Config) (*Egress, error) {
+	s, list, err := newEgressState(cfg, nil)
 	if err != nil {
 		return nil, err
 	}
-	fetcher, err := newFetcher(fetcherType, remote, httpClient, blockList)
+	e := &Egress{list: list, pac: &pacFile{list: list}}
+	e.state.Store(s)
+	return e, nil
+}
+
+// newEgressState returns the fetcher and the connector of the configuration,
+// and the block list loaded from its files. The fetcher and the connector use
+// list if it is not nil, or the loaded block list otherwise.
+func newEgressState(cfg *Config, list *blockList) (*egressState, *blockList, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	servers, err := cfg.remoteServers()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	connector, err := newConnector(connectorType, remote, fetcher, blockList, workDir)
+	tlsConfig, err := cfg.remoteTLS()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	directProxy, remoteProxy, err := cfg.upstreamProxies()
+	if err != nil {
+		return nil, nil, err
+	}
+	remoteTransport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.Timeout.Dial,
+			KeepAlive: cfg.Timeout.KeepAlive,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: cfg.Timeout.TLSHandshake,
+	}
+	if remoteProxy != nil {
+		remoteTransport.DialContext = remoteProxy.dialContext
+	}
+	httpClient := &http.Client{Transport: remoteTransport}
+	key, err := loadAuthKey(cfg.Path(cfg.Remote.Auth))
+	if err != nil {
+		return nil, nil, err
+	}
+	rules, err := loadRemoteRules(cfg.Path(cfg.Route.Remotes), servers)
+	if err != nil {
+		return nil, nil, err
+	}
+	remotes := newRemoteSet(servers, httpClient, remoteProxy, tlsConfig, key, cfg.Timeout.Dial, cfg.Remote.Mux)
+	remotes.rules = rules
+	dns := newResolver(remotes)
+	dns.proxy = directProxy
+	dns.dialTimeout = cfg.Timeout.Dial
+	directTransport := &http.Transport{
+		DialContext:         dns.dialContext,
+		TLSHandshakeTimeout: cfg.Timeout.TLSHandshake,
 	}
+	directClient := &http.Client{Transport: directTransport}
+	loaded, err := newBlockList(
+		cfg.Path(cfg.Route.BlockList),
+		cfg.Path(cfg.Route.DirectList),
+		cfg.Path(cfg.Route.Rules),
+		cfg.Path(cfg.Route.Countries),
+		dns)
+	if err != nil {
+		remotes.close()
+		return nil, nil, err
+	}
+	dns.countries = loaded.countries
+	if list == nil {
+		list = loaded
+	}
+	fetcher, err := newFetcher(cfg.Route.Fetch, remotes, directClient, list)
+	if err != nil {
+		remotes.close()
+		return nil, nil, err
+	}
+	connector, err := newConnector(cfg.Route.Connect, remotes, fetcher, list, dns, cfg.Path(cfg.TLS.CertDir), cfg.Route.Race)
+	if err != nil {
+		remotes.close()
+		return nil, nil, err
+	}
+	remotes.watch(cfg.Remote.ProbeInterval)
+	return &egressState{
+		cfg:        cfg,
+		fetcher:    fetcher,
+		connector:  connector,
+		remotes:    remotes,
+		transports: []*http.Transport{remoteTransport, directTransport},
+	}, loaded, nil
+}
 
-	return &Egress{fetcher, connector}, nil
+// loadAuthKey returns the first key in the file, or nil if the file does not
+// exist.
+func loadAuthKey(file string) (*protocol.Key, error) {
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		log.Printf("no auth key file %s, requests to the remote are not signed", file)
+		return nil, nil
+	}
+	keys, err := protocol.LoadKeys(file)
+	if err != nil {
+		return nil, err
+	}
+	return &keys[0], nil
 }
 
 func (e *Egress) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Host == "" && req.URL.Path == "/proxy.pac" && e.pac != nil {
+		e.pac.ServeHTTP(w, req)
+		return
+	}
 	if req.Method == "CONNECT" {
 		if err := e.serveConnect(w, req); err != nil {
 			log.Print(err)
@@ -55,7 +146,9 @@ func (e *Egress) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 func (e *Egress) serveOthers(w http.ResponseWriter, req *http.Request) error {
-	resp, err := e.fetch(req)
+	s := e.acquire()
+	defer s.release()
+	resp, err := s.fetch(req)
 	if err != nil {
 		w.WriteHeader(http.StatusGatewayTimeout)
 		return errors.Wrap(err)
@@ -63,6 +156,9 @@ func (e *Egress) serveOthers(w http.ResponseWriter, req *http.Request) error {
 	defer resp.Body.Close()
 
 	copyHeader(w.Header(), resp.Header)
+	for k := range resp.Trailer {
+		w.Header().Add("Trailer", k)
+	}
 	w.WriteHeader(resp.StatusCode)
 	_, err = io.Copy(w, resp.Body)
 	if err != nil {
@@ -71,6 +167,7 @@ func (e *Egress) serveOthers(w http.ResponseWriter, req *http.Request) error {
 		}
 		return nil
 	}
+	copyHeader(w.Header(), resp.Trailer)
 	return nil
 }
 func copyHeader(dst, src http.Header) {
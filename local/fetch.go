@@ -5,9 +5,10 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
-	"path"
+	"sync"
 
 	"h12.io/egress/protocol"
 	"h12.io/errors"
@@ -17,18 +18,16 @@ type fetcher interface {
 	fetch(req *http.Request) (*http.Response, error)
 }
 
-func newFetcher(typ string, remote *url.URL, httpClient *http.Client, blockList *blockList) (fetcher, error) {
-	fetchRemote := *remote
-	fetchRemote.Path = path.Join(fetchRemote.Path, "f")
+func newFetcher(typ string, remotes *remoteSet, directClient *http.Client, blockList *blockList) (fetcher, error) {
 	switch typ {
 	case "direct":
 		log.Print("fetch DIRECTLY only!")
-		return &directFetcher{httpClient}, nil
+		return &directFetcher{directClient}, nil
 	case "remote":
 		log.Print("fetch from REMOTE only!")
-		return &remoteFetcher{httpClient, fetchRemote.String()}, nil
+		return &remoteFetcher{remotes}, nil
 	case "smart":
-		return newSmartFetcher(httpClient, fetchRemote.String(), blockList)
+		return newSmartFetcher(remotes, directClient, blockList)
 	}
 	return nil, errors.Format("wrong fetcher type: %s", typ)
 }
@@ -42,24 +41,125 @@ func (d *directFetcher) fetch(req *http.Request) (*http.Response, error) {
 }
 
 type remoteFetcher struct {
-	client *http.Client
-	remote string
+	remotes *remoteSet
 }
 
+// maxReplayBody is the largest request body kept in memory to fail over to
+// another remote. A larger body streams to the first remote only.
+const maxReplayBody = 1 << 20
+
+// fetch fetches through the remotes for the host in turn until one of them
+// succeeds, or the response or the error of the last one is returned.
 func (g *remoteFetcher) fetch(req *http.Request) (*http.Response, error) {
 	log.Printf("fetch: %v", req.URL)
-	req, err := protocol.MarshalRequest(req, g.remote)
-	if err != nil {
-		return nil, err
+	remotes := g.remotes.candidatesFor(fetchURL(req).Host)
+	var getBody func() (io.ReadCloser, error)
+	var err error
+	if len(remotes) > 1 && req.Body != nil && req.Body != http.NoBody {
+		if getBody, err = replayableBody(req); err != nil {
+			return nil, err
+		}
+		if getBody == nil {
+			log.Printf("fetch %v: body too large to fail over", req.URL)
+			remotes = remotes[:1]
+		}
+	}
+	var resp *http.Response
+	for i, r := range remotes {
+		if i > 0 {
+			log.Printf("fetch %v through remote %s instead", req.URL, r.name)
+			if req.Body, err = getBody(); err != nil {
+				return nil, err
+			}
+		}
+		var body *closeSignal
+		if getBody != nil {
+			body = newCloseSignal(req.Body)
+			req.Body = body
+		}
+		var status int
+		resp, status, err = g.fetchFrom(r, req)
+		if !r.check(status, err) {
+			break
+		}
+		if body != nil {
+			// the body is being written until closed
+			<-body.closed
+		}
 	}
-	resp, err := g.client.Do(req)
+	return resp, err
+}
+
+// replayableBody returns a function returning a new copy of the body of req,
+// either by req.GetBody or from the body buffered in memory. It returns nil if
+// the body is larger than maxReplayBody, and req.Body still has the whole body.
+func replayableBody(req *http.Request) (func() (io.ReadCloser, error), error) {
+	if req.GetBody != nil {
+		return req.GetBody, nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, maxReplayBody+1))
 	if err != nil {
 		return nil, errors.Wrap(err)
 	}
+	if len(data) > maxReplayBody {
+		req.Body = &chainCloser{ioutil.NopCloser(io.MultiReader(bytes.NewReader(data), req.Body)), req.Body}
+		return nil, nil
+	}
+	req.Body.Close()
+	getBody := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	req.Body, _ = getBody()
+	return getBody, nil
+}
+
+// closeSignal tells when a request body is closed, which http.Request.Write
+// does when it finishes with the body.
+type closeSignal struct {
+	io.ReadCloser
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newCloseSignal(rc io.ReadCloser) *closeSignal {
+	return &closeSignal{ReadCloser: rc, closed: make(chan struct{})}
+}
+
+func (c *closeSignal) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(func() { close(c.closed) })
+	return err
+}
+
+// fetchFrom fetches through a remote, and returns the response and the status
+// of the remote, which is not the status of the response from the destination.
+// On failure the marshaled request is closed so that the body of req is no
+// longer read.
+func (g *remoteFetcher) fetchFrom(remote *remoteServer, req *http.Request) (*http.Response, int, error) {
+	body := req.Body
+	req, err := protocol.MarshalRequest(req, remote.endpoint("f").String())
+	if err != nil {
+		if body != nil {
+			body.Close()
+		}
+		return nil, 0, err
+	}
+	if g.remotes.key != nil {
+		if err := g.remotes.key.Sign(req); err != nil {
+			req.Body.Close()
+			return nil, 0, err
+		}
+	}
+	resp, err := g.remotes.client.Do(req)
+	if err != nil {
+		req.Body.Close()
+		return nil, 0, errors.Wrap(err)
+	}
 	if resp.StatusCode != http.StatusOK {
 		log.Printf("resp status: %v", resp.StatusCode)
 		resp.Body.Close()
-		return resp, nil
+		req.Body.Close()
+		return resp, resp.StatusCode, nil
 	}
 	log.Print("unmarshaling body")
 	r, err := protocol.UnmarshalResponse(resp, req)
@@ -69,7 +169,7 @@ func (g *remoteFetcher) fetch(req *http.Request) (*http.Response, error) {
 	} else {
 		resp.Body.Close()
 	}
-	return r, err
+	return r, resp.StatusCode, err
 }
 
 type chainCloser struct {
@@ -88,28 +188,34 @@ type smartFetcher struct {
 	list   *blockList
 }
 
-func newSmartFetcher(client *http.Client, remote string, blockList *blockList) (*smartFetcher, error) {
+func newSmartFetcher(remotes *remoteSet, directClient *http.Client, blockList *blockList) (*smartFetcher, error) {
 	return &smartFetcher{
-		&directFetcher{client},
-		&remoteFetcher{client, remote},
+		&directFetcher{directClient},
+		&remoteFetcher{remotes},
 		blockList,
 	}, nil
 }
 
 func (d *smartFetcher) fetch(req *http.Request) (*http.Response, error) {
-	if d.list.has(req.Host) {
+	switch d.list.routeHost(fetchURL(req)) {
+	case routeRemote:
 		return d.remote.fetch(req)
+	case routeDirect:
+		return d.direct.fetch(req)
 	}
 	rec := newBodyRecorder(req.Body)
 	req.Body = rec
-	resp, err := d.direct.fetch(req)
-	if err == nil {
-		return resp, err
+	resp, directErr := d.direct.fetch(req)
+	if directErr == nil {
+		return resp, nil
 	}
+	var err error
 	req.Body, err = rec.reborn()
 	if err != nil {
 		return nil, err
 	}
+	target := hostPort(fetchURL(req))
+	class := classifyFailure(d.list.resolver(), target, directErr)
 	resp, err = d.remote.fetch(req)
 	if err != nil {
 		return nil, err
@@ -117,7 +223,11 @@ func (d *smartFetcher) fetch(req *http.Request) (*http.Response, error) {
 	if len(rec.data) > 0 {
 		log.Print("REBORN SUCCESS!")
 	}
-	if err := d.list.add(req.Host); err != nil {
+	if !class.interference() {
+		log.Printf("%s: direct fetch failed (%s), not learned: %s", target, class, directErr.Error())
+		return resp, nil
+	}
+	if err := d.list.add(target, class, directErr.Error()); err != nil {
 		log.Printf("fail to write list file: %s", err.Error())
 	}
 	return resp, nil
@@ -151,3 +261,23 @@ func (b *bodyRecorder) reborn() (io.ReadCloser, error) {
 	}
 	return ioutil.NopCloser(bytes.NewReader(b.data)), nil
 }
+
+// fetchURL returns the absolute URL of a proxied request.
+func fetchURL(req *http.Request) *url.URL {
+	if req.URL.Host != "" {
+		return req.URL
+	}
+	u := *req.URL
+	u.Scheme, u.Host = "http", req.Host
+	return &u
+}
+
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
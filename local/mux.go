@@ -0,0 +1,177 @@
+package local
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"h12.io/egress/mux"
+	"h12.io/egress/protocol"
+	"h12.io/errors"
+)
+
+const (
+	muxKeepAlive   = 30 * time.Second
+	muxOpenTimeout = 15 * time.Second
+	muxRetryDelay  = 5 * time.Minute
+)
+
+var errMuxUnavailable = errors.New("multiplexed remote is unavailable")
+
+// muxPool keeps a few long-lived multiplexed connections to the remote and
+// spreads CONNECT tunnels over them. When the remote does not support
+// multiplexing, errMuxUnavailable is returned so that the caller falls back
+// to one connection per tunnel, and no retry is made for a while. New
+// connections are made one at a time without holding the lock, so that a
+// slow remote only holds up the tunnels waiting for the first connection.
+type muxPool struct {
+	remote      *url.URL
+	proxy       *upstreamProxy
+	tls         *tls.Config
+	key         *protocol.Key
+	dialTimeout time.Duration // 0 for none
+	size        int
+	sessions    []*mux.Session
+	next        int
+	retryAt     time.Time
+	dialing     chan struct{}      // closed when the pending connect is done
+	cancelDial  context.CancelFunc // of the pending connect
+	mu          sync.Mutex
+}
+
+func newMuxPool(remote *url.URL, proxy *upstreamProxy, tlsConfig *tls.Config, key *protocol.Key, dialTimeout time.Duration, size int) *muxPool {
+	muxRemote := *remote
+	muxRemote.Path = path.Join(muxRemote.Path, "/m")
+	return &muxPool{
+		remote:      &muxRemote,
+		proxy:       proxy,
+		tls:         tlsConfig,
+		key:         key,
+		dialTimeout: dialTimeout,
+		size:        size,
+	}
+}
+
+// session returns one of the connections, starting a new one in the
+// background if there are fewer than the pool size. It only waits for the new
+// one, or until ctx is done, if there is none.
+func (p *muxPool) session(ctx context.Context) (*mux.Session, error) {
+	for {
+		p.mu.Lock()
+		alive := p.sessions[:0]
+		for _, s := range p.sessions {
+			if !s.IsClosed() {
+				alive = append(alive, s)
+			}
+		}
+		p.sessions = alive
+		if len(p.sessions) < p.size && time.Now().After(p.retryAt) && p.dialing == nil {
+			p.startConnect()
+		}
+		if len(p.sessions) > 0 {
+			p.next = (p.next + 1) % len(p.sessions)
+			s := p.sessions[p.next]
+			p.mu.Unlock()
+			return s, nil
+		}
+		dialing := p.dialing
+		p.mu.Unlock()
+		if dialing == nil {
+			return nil, errMuxUnavailable
+		}
+		select {
+		case <-dialing:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// startConnect connects a new session in the background, called with p.mu
+// held.
+func (p *muxPool) startConnect() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	p.dialing, p.cancelDial = done, cancel
+	go func() {
+		defer close(done)
+		defer cancel()
+		if p.dialTimeout > 0 {
+			var cancelTimeout context.CancelFunc
+			ctx, cancelTimeout = context.WithTimeout(ctx, p.dialTimeout)
+			defer cancelTimeout()
+		}
+		s, err := p.connect(ctx)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.dialing, p.cancelDial = nil, nil
+		switch {
+		case err != nil:
+			log.Printf("fail to connect multiplexed remote, retry after %v: %s", muxRetryDelay, err.Error())
+			p.retryAt = time.Now().Add(muxRetryDelay)
+		case p.size == 0: // closed in the meantime
+			s.Close()
+		default:
+			p.sessions = append(p.sessions, s)
+		}
+	}()
+}
+
+func (p *muxPool) connect(ctx context.Context) (*mux.Session, error) {
+	conn, resp, err := dialRemote(ctx, p.remote, p.proxy, p.tls, p.key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.Format("error response from remote: %s", resp.Status)
+	}
+	log.Printf("multiplexed remote connected: %s", p.remote.String())
+	return mux.Client(conn, muxKeepAlive), nil
+}
+
+// close closes the multiplexed connections and cancels the pending connect,
+// after which no more is made.
+func (p *muxPool) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.sessions {
+		s.Close()
+	}
+	if p.cancelDial != nil {
+		p.cancelDial()
+	}
+	p.sessions = nil
+	p.size = 0
+}
+
+// dial opens a stream to host through a multiplexed connection, waiting for
+// one until ctx is done.
+func (p *muxPool) dial(ctx context.Context, host string) (io.ReadWriteCloser, error) {
+	s, err := p.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := s.Open(host, muxOpenTimeout)
+	if err != nil {
+		if e, ok := err.(*mux.OpenError); ok {
+			return nil, &remoteError{e.Status, err}
+		}
+		if s.IsClosed() {
+			log.Printf("multiplexed remote closed: %v", err)
+			return nil, errMuxUnavailable
+		}
+		// no answer from the remote itself, unlike a 504 response
+		return nil, err
+	}
+	return stream, nil
+}
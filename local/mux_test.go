@@ -0,0 +1,60 @@
+package local
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBlackholedRemote(t *testing.T) {
+	blackhole, closed := fakeSlowProxy(t, -1)
+	defer blackhole.Close()
+	u := &url.URL{Scheme: "http", Host: blackhole.Addr().String()}
+
+	p := newMuxPool(u, nil, nil, nil, 200*time.Millisecond, 2)
+	start := time.Now()
+	if _, err := p.dial(context.Background(), "example.com:443"); err != errMuxUnavailable {
+		t.Fatalf("expect the mux unavailable, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expect the connect bounded by the dial timeout, took %v", d)
+	}
+	if _, err := p.dial(context.Background(), "example.com:443"); err != errMuxUnavailable {
+		t.Fatalf("expect no retry for a while, got %v", err)
+	}
+	<-closed
+
+	server := newRemoteServer("blackholed", u, 1)
+	c := &remoteConnector{newRemoteSet([]*remoteServer{server}, nil, nil, nil, nil, 200*time.Millisecond, 0)}
+	start = time.Now()
+	if _, err := c.dial(context.Background(), "example.com:443"); err == nil || !server.isDown() {
+		t.Fatalf("expect the remote down after the dial timeout, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expect the tunnel bounded by the dial timeout, took %v", d)
+	}
+	<-closed
+
+	p = newMuxPool(u, nil, nil, nil, time.Minute, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.dial(ctx, "example.com:443"); err != context.DeadlineExceeded {
+		t.Fatalf("expect the wait cancelled, got %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		p.close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expect close not blocked by the pending connect")
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expect the pending connect cancelled by close")
+	}
+}
@@ -0,0 +1,146 @@
+package local
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"h12.io/egress/geoip"
+)
+
+// pacFile generates a PAC file from the block list, so that browsers go
+// directly to destinations that will not be proxied anyway. It is regenerated
+// whenever the block list or the GeoIP database changes.
+type pacFile struct {
+	list    *blockList
+	proxy   string
+	version int
+	db      *geoip.DB
+	data    []byte
+	mu      sync.Mutex
+}
+
+func (p *pacFile) get(proxy string) ([]byte, error) {
+	version, db := p.list.getVersion(), geoip.Default()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.data != nil && p.version == version && p.db == db && p.proxy == proxy {
+		return p.data, nil
+	}
+	data, err := p.list.pac(proxy)
+	if err != nil {
+		return nil, err
+	}
+	p.data, p.version, p.db, p.proxy = data, version, db, proxy
+	return data, nil
+}
+
+func (p *pacFile) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// the proxy is the address the client used to get the PAC file
+	data, err := p.get("PROXY " + req.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Write(data)
+}
+
+func (l *blockList) getVersion() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.version
+}
+
+func (l *blockList) pac(proxy string) ([]byte, error) {
+	l.mu.Lock()
+	vars := []struct {
+		name  string
+		value interface{}
+	}{
+		{"proxy", proxy},
+		{"direct", l.direct.flags()},
+		{"block", l.block.flags()},
+		{"exceptions", l.rules.except.domains.flags()},
+		{"rules", l.rules.proxy.domains.flags()},
+		{"directCountries", countryRanges(l.countries.direct)},
+		{"remoteCountries", countryRanges(l.countries.remote)},
+	}
+	l.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, v := range vars {
+		js, err := json.Marshal(v.value)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "var %s = %s;\n", v.name, js)
+	}
+	buf.WriteString(pacFunctions)
+	return buf.Bytes(), nil
+}
+
+// countryRanges returns the sorted IPv4 ranges of the countries in the
+// default GeoIP database.
+func countryRanges(codes map[string]bool) geoip.IPNetListV4 {
+	db := geoip.Default()
+	ranges := geoip.IPNetListV4{}
+	for code := range codes {
+		ranges = append(ranges, db.Country(code).V4...)
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Lo < ranges[j].Lo })
+	return ranges
+}
+
+// pacFunctions follows blockList.routeHost, except that URL rules other than
+// domains are left to the proxy, and that the country is decided by one IPv4
+// address of the destination.
+const pacFunctions = `
+function match(rules, host) {
+  var labels = host.split("."), best = 0;
+  for (var i = labels.length - 1; i >= 0; i--) {
+    var f = rules[labels.slice(i).join(".")];
+    if (f === undefined) continue;
+    var depth = labels.length - i;
+    if (i == 0 && (f & 1)) best = 2 * depth + 1;
+    else if (i > 0 && (f & 2)) best = 2 * depth;
+  }
+  return best;
+}
+
+function ipToNum(ip) {
+  var p = ip.split(".");
+  return ((+p[0]) * 256 * 256 * 256) + ((+p[1]) * 256 * 256) + ((+p[2]) * 256) + (+p[3]);
+}
+
+function inRanges(ranges, ip) {
+  var n = ipToNum(ip), lo = 0, hi = ranges.length;
+  while (lo < hi) {
+    var mid = (lo + hi) >> 1;
+    if (ranges[mid].Hi < n) lo = mid + 1; else hi = mid;
+  }
+  return lo < ranges.length && ranges[lo].Lo <= n && n <= ranges[lo].Hi;
+}
+
+function FindProxyForURL(url, host) {
+  host = host.toLowerCase();
+  if (isPlainHostName(host)) return "DIRECT";
+  var d = match(direct, host), b = match(block, host);
+  if (d > 0 && d >= b) return "DIRECT";
+  if (match(exceptions, host) > 0) return "DIRECT";
+  if (match(rules, host) > 0 || b > 0) return proxy;
+  var ip = dnsResolve(host);
+  if (ip && /^\d+\.\d+\.\d+\.\d+$/.test(ip)) {
+    if (isInNet(ip, "10.0.0.0", "255.0.0.0") ||
+        isInNet(ip, "172.16.0.0", "255.240.0.0") ||
+        isInNet(ip, "192.168.0.0", "255.255.0.0") ||
+        isInNet(ip, "127.0.0.0", "255.0.0.0")) return "DIRECT";
+    if (inRanges(remoteCountries, ip)) return proxy;
+    if (inRanges(directCountries, ip)) return "DIRECT";
+  }
+  return proxy;
+}
+`
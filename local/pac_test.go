@@ -0,0 +1,69 @@
+package local
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"h12.io/egress/geoip"
+)
+
+func TestPAC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "directlist"), []byte(".direct.com\n"), 0600)
+	l, err := newBlockList(path.Join(dir, "blocklist"), path.Join(dir, "directlist"), path.Join(dir, "rules"), path.Join(dir, "countries"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Egress{pac: &pacFile{list: l}}
+	req := httptest.NewRequest("GET", "/proxy.pac", nil)
+	req.Host = "127.0.0.1:1984"
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	pac := w.Body.Bytes()
+	for _, s := range []string{
+		`var proxy = "PROXY 127.0.0.1:1984";`,
+		`var direct = {"direct.com":3};`,
+		`var block = {};`,
+		`function FindProxyForURL(url, host)`,
+		`var directCountries = [{"Lo":16777472,"Hi":16778239}`, // 1.0.1.0 - 1.0.3.255, merged
+		`var remoteCountries = [];`,
+	} {
+		if !bytes.Contains(pac, []byte(s)) {
+			t.Fatalf("expect %s in PAC file", s)
+		}
+	}
+
+	l.block.add(".blocked.com")
+	l.version++
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	if !bytes.Contains(w.Body.Bytes(), []byte(`var block = {"blocked.com":3};`)) {
+		t.Fatal("PAC file is not regenerated")
+	}
+
+	ioutil.WriteFile(path.Join(dir, geoip.LocationsFile), []byte(
+		"geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name\n"+
+			"1814991,en,AS,Asia,CN,China\n"), 0600)
+	ioutil.WriteFile(path.Join(dir, geoip.BlocksV4File), []byte(
+		"network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider\n"+
+			"8.8.8.0/24,1814991,1814991,,0,0\n"), 0600)
+	db, err := geoip.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	geoip.SetDefault(db)
+	defer geoip.SetDefault(geoip.Embedded)
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	if !bytes.Contains(w.Body.Bytes(), []byte(`var directCountries = [{"Lo":134744064,"Hi":134744319}];`)) {
+		t.Fatal("PAC file is not regenerated with the GeoIP database")
+	}
+}
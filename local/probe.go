@@ -0,0 +1,158 @@
+package local
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"h12.io/errors"
+)
+
+const (
+	blockListSaveInterval = time.Minute
+	probeInterval         = 10 * time.Minute
+	probeTimeout          = 10 * time.Second
+)
+
+// ProbeBlockList saves the statistics of the block list periodically in the
+// background. If ttl is positive, entries learned or probed longer than ttl
+// ago are probed directly, at most concurrency at a time, and removed from the
+// block list if the probe succeeds. ttl and concurrency are replaced by the
+// configuration on reload.
+func (e *Egress) ProbeBlockList(ttl time.Duration, concurrency int) {
+	e.list.setProbe(ttl, concurrency)
+	e.maintain.Do(func() {
+		go e.list.maintain()
+	})
+}
+
+func (l *blockList) setProbe(ttl time.Duration, concurrency int) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	l.mu.Lock()
+	l.probeTTL, l.probes = ttl, concurrency
+	l.mu.Unlock()
+}
+
+func (l *blockList) maintain() {
+	saveTicker := time.NewTicker(blockListSaveInterval)
+	defer saveTicker.Stop()
+	probeTicker := time.NewTicker(probeInterval)
+	defer probeTicker.Stop()
+	for {
+		select {
+		case <-saveTicker.C:
+			if err := l.save(); err != nil {
+				log.Printf("fail to write list file: %s", err.Error())
+			}
+		case <-probeTicker.C:
+			l.mu.Lock()
+			ttl, concurrency := l.probeTTL, l.probes
+			l.mu.Unlock()
+			if ttl > 0 {
+				l.probe(ttl, concurrency)
+			}
+		}
+	}
+}
+
+func (l *blockList) probe(ttl time.Duration, concurrency int) {
+	var due []blockEntry
+	now := time.Now()
+	l.mu.Lock()
+	for _, e := range l.entries {
+		last := e.Probed
+		if last.IsZero() {
+			last = e.FirstSeen
+		}
+		if now.Sub(last) > ttl {
+			due = append(due, *e)
+		}
+	}
+	l.mu.Unlock()
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, e := range due {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(e blockEntry) {
+			defer func() { <-sem; wg.Done() }()
+			target := probeTarget(&e)
+			err := probeDirect(l.resolver(), target)
+			if err == nil {
+				if err := l.demote(e.Rule); err != nil {
+					log.Printf("fail to write list file: %s", err.Error())
+				}
+				return
+			}
+			log.Printf("probe %s: still blocked: %s", e.Rule, err.Error())
+			class := classifyFailure(l.resolver(), target, err)
+			l.mu.Lock()
+			if entry := l.entries[e.Rule]; entry != nil {
+				entry.Probed = time.Now()
+				entry.Class = string(class)
+				entry.Reason = err.Error()
+				l.dirty = true
+			}
+			l.mu.Unlock()
+		}(e)
+	}
+	wg.Wait()
+}
+
+// probeTarget returns the host:port to probe for an entry. Entries without a
+// host are converted from old block list files.
+func probeTarget(e *blockEntry) string {
+	if e.Host != "" {
+		return e.Host
+	}
+	host := strings.TrimPrefix(e.Rule, ".")
+	if strings.HasPrefix(host, "*.") {
+		host = "www." + host[2:]
+	}
+	return net.JoinHostPort(host, "443")
+}
+
+// probeDirect checks if hostPort can be reached directly: an HTTP request
+// for port 80, a TLS handshake for port 443 and a TCP connection otherwise.
+func probeDirect(dns *resolver, hostPort string) error {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	if port == "80" {
+		client := &http.Client{
+			Timeout: probeTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return dns.dial(ctx, addr, probeTimeout)
+				},
+			},
+		}
+		resp, err := client.Head("http://" + hostPort + "/")
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		resp.Body.Close()
+		return nil
+	}
+	conn, err := dns.dial(ctx, hostPort, probeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if port == "443" {
+		conn.SetDeadline(time.Now().Add(probeTimeout))
+		return errors.Wrap(tls.Client(conn, &tls.Config{ServerName: host}).Handshake())
+	}
+	return nil
+}
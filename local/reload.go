@@ -0,0 +1,204 @@
+package local
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"h12.io/egress/geoip"
+)
+
+// egressState is the fetcher and the connector of a configuration, replaced
+// as a whole on reload. A retired state is closed when the last request using
+// it finishes.
+type egressState struct {
+	cfg *Config
+	fetcher
+	connector
+	remotes    *remoteSet
+	transports []*http.Transport
+	refs       int
+	retired    bool
+	mu         sync.Mutex
+}
+
+// acquire returns the current state, which must be released after use.
+func (e *Egress) acquire() *egressState {
+	for {
+		s := e.state.Load().(*egressState)
+		s.mu.Lock()
+		if !s.retired {
+			s.refs++
+			s.mu.Unlock()
+			return s
+		}
+		// replaced in the meantime
+		s.mu.Unlock()
+	}
+}
+
+func (s *egressState) release() {
+	s.mu.Lock()
+	s.refs--
+	idle := s.retired && s.refs == 0
+	s.mu.Unlock()
+	if idle {
+		s.close()
+	}
+}
+
+func (s *egressState) retire() {
+	s.mu.Lock()
+	s.retired = true
+	idle := s.refs == 0
+	s.mu.Unlock()
+	if idle {
+		s.close()
+	}
+}
+
+func (s *egressState) close() {
+	s.remotes.close()
+	for _, t := range s.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+// connect connects through the connector of the current configuration.
+func (e *Egress) connect(w http.ResponseWriter, hostPort string) error {
+	s := e.acquire()
+	defer s.release()
+	return s.connect(w, hostPort)
+}
+
+// Reload replaces the configuration, and reloads the lists, the rules and the
+// GeoIP database. New requests use the fetcher and the connector of the new
+// configuration, while the ones in flight, including tunnels, finish with the
+// old ones. Everything is loaded before anything is replaced, so the current
+// configuration is kept as a whole if the new one fails to load, while a GeoIP
+// database failing to load is only logged. Listening addresses and timeouts of
+// the listeners are not changed until restart.
+func (e *Egress) Reload(cfg *Config) error {
+	e.reloadMu.Lock()
+	defer e.reloadMu.Unlock()
+	commitGeoIP, err := geoip.Prepare(cfg.Dir)
+	if err != nil {
+		log.Printf("fail to reload GeoIP database: %s", err.Error())
+		commitGeoIP = func() {}
+	}
+	s, loaded, err := newEgressState(cfg, e.list)
+	if err != nil {
+		return err
+	}
+	logOutput, logFlags, err := cfg.openLog()
+	if err != nil {
+		s.close()
+		return err
+	}
+	if err := e.list.replace(loaded); err != nil {
+		s.close()
+		if logOutput != nil {
+			logOutput.Close()
+		}
+		return err
+	}
+	setLog(logOutput, logFlags)
+	e.list.setProbe(cfg.Route.BlockTTL, cfg.Route.Probes)
+	old := e.state.Load().(*egressState)
+	e.state.Store(s)
+	old.retire()
+	commitGeoIP()
+	if !reflect.DeepEqual(old.cfg.Listen, cfg.Listen) {
+		log.Print("changes of listening addresses take effect after restart")
+	}
+	log.Printf("configuration reloaded from %s", cfg.Dir)
+	return nil
+}
+
+// Watch reloads the egress with the configuration returned by load when
+// SIGHUP is received, or when any file of the current configuration is found
+// changed, checked every interval. The commit function returned by load is
+// called after the configuration is reloaded successfully, to apply what the
+// egress does not own, e.g. the secret shared with the remotes.
+func (e *Egress) Watch(interval time.Duration, load func() (cfg *Config, commit func(), err error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		mods := e.modTimes()
+		for {
+			select {
+			case <-hup:
+				log.Print("SIGHUP received, reloading")
+			case <-ticker.C:
+				if sameModTimes(e.modTimes(), mods) && !e.list.changedOnDisk() {
+					continue
+				}
+				log.Print("configuration changed, reloading")
+			}
+			cfg, commit, err := load()
+			if err == nil {
+				err = e.Reload(cfg)
+			}
+			if err != nil {
+				log.Printf("fail to reload, keeping the current configuration: %s", err.Error())
+			} else {
+				commit()
+			}
+			mods = e.modTimes()
+		}
+	}()
+}
+
+// modTimes returns the modification times of the files of the current
+// configuration and the GeoIP database, except the block list, which is
+// changed by the egress itself.
+func (e *Egress) modTimes() map[string]time.Time {
+	cfg := e.state.Load().(*egressState).cfg
+	files := []string{
+		path.Join(cfg.Dir, ConfigFile),
+		cfg.Path(cfg.Route.DirectList),
+		cfg.Path(cfg.Route.Countries),
+		cfg.Path(cfg.Route.Remotes),
+		cfg.Path(cfg.Remote.Auth),
+		cfg.Path(cfg.Remote.Secret),
+		cfg.Path(cfg.TLS.CA),
+	}
+	files = append(files, geoip.Files(cfg.Dir)...)
+	rulesDir := cfg.Path(cfg.Route.Rules)
+	if infos, err := ioutil.ReadDir(rulesDir); err == nil {
+		for _, fi := range infos {
+			files = append(files, path.Join(rulesDir, fi.Name()))
+		}
+	}
+	mods := make(map[string]time.Time)
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		if fi, err := os.Stat(file); err == nil {
+			mods[file] = fi.ModTime()
+		}
+	}
+	return mods
+}
+
+func sameModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for file, t := range a {
+		if !b[file].Equal(t) {
+			return false
+		}
+	}
+	return true
+}
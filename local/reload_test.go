@@ -0,0 +1,107 @@
+package local
+
+import (
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"h12.io/egress/geoip"
+)
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := path.Join(dir, ConfigFile)
+	ioutil.WriteFile(configFile, []byte("[route]\nconnect = \"direct\"\n"), 0600)
+	cfg, err := LoadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewEgress(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.list.add("8.8.8.8:443", failureReset, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	old := e.acquire()
+	ioutil.WriteFile(configFile, []byte("[route]\nconnect = \"remote\"\n"), 0600)
+	ioutil.WriteFile(path.Join(dir, "directlist"), []byte(".example.com\n"), 0600)
+	cfg, err = LoadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := old.connector.(*directConnector); !ok || !old.retired || old.refs != 1 {
+		t.Fatal("expect the old connector kept for the request in flight")
+	}
+	old.release()
+	s := e.acquire()
+	if _, ok := s.connector.(*remoteConnector); !ok {
+		t.Fatalf("expect the new connector, got %T", s.connector)
+	}
+	s.release()
+	if e.list.route(&url.URL{Host: "8.8.8.8"}) != routeRemote {
+		t.Fatal("expect the learned entry kept")
+	}
+	if e.list.route(&url.URL{Host: "www.example.com"}) != routeDirect {
+		t.Fatal("expect the direct list reloaded")
+	}
+
+	cfg.Route.Connect = "fast"
+	if err := e.Reload(cfg); err == nil {
+		t.Fatal("expect error of an invalid configuration")
+	}
+	if s := e.acquire(); s.retired {
+		t.Fatal("expect the current state kept on error")
+	} else {
+		s.release()
+	}
+
+	defer geoip.SetDefault(geoip.Embedded)
+	ioutil.WriteFile(path.Join(dir, geoip.LocationsFile), []byte(
+		"geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name\n"+
+			"6252001,en,NA,\"North America\",US,\"United States\"\n"), 0600)
+	ioutil.WriteFile(path.Join(dir, geoip.BlocksV4File), []byte(
+		"network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider\n"+
+			"8.8.8.0/24,6252001,6252001,,0,0\n"), 0600)
+	cfg.Route.Connect = "smart"
+	cfg.Log.File = "missing/egress.log"
+	if err := e.Reload(cfg); err == nil {
+		t.Fatal("expect error of a log file that cannot be opened")
+	}
+	if geoip.Default() != geoip.Embedded {
+		t.Fatal("expect the GeoIP database not replaced on error")
+	}
+	cfg.Log.File = ""
+	if err := e.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if geoip.Default().Lookup(net.ParseIP("8.8.8.8")) != "US" {
+		t.Fatal("expect the GeoIP database reloaded")
+	}
+
+	listFile := path.Join(dir, "blocklist")
+	ioutil.WriteFile(listFile, []byte("blocked.example.org\n"), 0600)
+	os.Chtimes(listFile, time.Now(), time.Now().Add(time.Minute))
+	if !e.list.changedOnDisk() {
+		t.Fatal("expect the block list changed")
+	}
+	if err := e.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if e.list.route(&url.URL{Host: "8.8.8.8"}) != routeSmart ||
+		e.list.route(&url.URL{Host: "blocked.example.org"}) != routeRemote {
+		t.Fatal("expect the block list edited by others reloaded")
+	}
+}
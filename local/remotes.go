@@ -0,0 +1,343 @@
+package local
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"h12.io/egress/protocol"
+	"h12.io/errors"
+)
+
+const remoteProbeTimeout = 10 * time.Second
+
+// remoteServer is one of the remote egresses, with its health learned from
+// probes and requests.
+type remoteServer struct {
+	name    string
+	group   string // optional
+	url     *url.URL
+	weight  int
+	mux     *muxPool
+	down    bool
+	latency time.Duration // moving average of the probes, 0 if not probed
+	mu      sync.Mutex
+}
+
+func newRemoteServer(name string, u *url.URL, weight int) *remoteServer {
+	return &remoteServer{name: name, url: u, weight: weight}
+}
+
+// endpoint returns the URL of the handler with the name under the remote URL.
+func (r *remoteServer) endpoint(name string) *url.URL {
+	u := *r.url
+	u.Path = path.Join("/", u.Path, name)
+	return &u
+}
+
+func (r *remoteServer) isDown() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.down
+}
+
+func (r *remoteServer) getLatency() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.latency
+}
+
+// setUp marks the remote up, and updates the latency if it is positive.
+func (r *remoteServer) setUp(latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.down {
+		log.Printf("remote %s is up", r.name)
+	}
+	r.down = false
+	if latency > 0 {
+		if r.latency == 0 {
+			r.latency = latency
+		} else {
+			r.latency = (r.latency*3 + latency) / 4
+		}
+	}
+}
+
+func (r *remoteServer) setDown(cause error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.down {
+		log.Printf("remote %s is down: %s", r.name, cause.Error())
+	}
+	r.down = true
+}
+
+// check records the health of the remote by the result of a request through
+// it, and returns true if the request should be retried through another
+// remote, i.e. on an error or a 5xx response. A 504 response is neither
+// retried nor counted against the remote because it means the destination is
+// unreachable from the remote, which is likely the same through the others.
+func (r *remoteServer) check(status int, err error) (retry bool) {
+	switch {
+	case err != nil:
+		r.setDown(err)
+		return true
+	case status == http.StatusGatewayTimeout:
+		return false
+	case status >= 500:
+		r.setDown(errors.Format("error response %d", status))
+		return true
+	}
+	r.setUp(0)
+	return false
+}
+
+// remoteSet is the remote egresses of a configuration. Requests go to a
+// remote chosen randomly by weight among the ones up, and fail over to the
+// others in the order of latency, with the ones down as the last resort.
+// Requests to a domain with a remote rule only go to the remotes named by
+// the rule.
+type remoteSet struct {
+	remotes []*remoteServer
+	rules   *remoteRules
+	client  *http.Client
+	proxy   *upstreamProxy // for connections not made by client
+	tls     *tls.Config
+	key     *protocol.Key
+	timeout time.Duration // of connections not made by client, 0 for none
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// newRemoteSet returns the set of remotes, each with a pool of muxSessions
+// multiplexed connections if muxSessions is positive. The remotes are reached
+// through the upstream proxy if it is not nil, and connecting them times out
+// after dialTimeout unless it is 0.
+func newRemoteSet(remotes []*remoteServer, client *http.Client, proxy *upstreamProxy, tlsConfig *tls.Config, key *protocol.Key, dialTimeout time.Duration, muxSessions int) *remoteSet {
+	if muxSessions > 0 {
+		for _, r := range remotes {
+			r.mux = newMuxPool(r.url, proxy, tlsConfig, key, dialTimeout, muxSessions)
+		}
+	}
+	return &remoteSet{
+		remotes: remotes,
+		client:  client,
+		proxy:   proxy,
+		tls:     tlsConfig,
+		key:     key,
+		timeout: dialTimeout,
+		stop:    make(chan struct{}),
+	}
+}
+
+// candidatesFor returns the remotes in the order to try for host, limited to
+// the remote or the group of the rule matching host if any.
+func (s *remoteSet) candidatesFor(host string) []*remoteServer {
+	target := s.rules.match(host)
+	if target == "" {
+		return s.candidates()
+	}
+	var remotes []*remoteServer
+	for _, r := range s.candidates() {
+		if r.name == target || r.group == target {
+			remotes = append(remotes, r)
+		}
+	}
+	return remotes
+}
+
+// candidates returns the remotes in the order to try.
+func (s *remoteSet) candidates() []*remoteServer {
+	var up, down []*remoteServer
+	for _, r := range s.remotes {
+		if r.isDown() {
+			down = append(down, r)
+		} else {
+			up = append(up, r)
+		}
+	}
+	byLatency(up)
+	byLatency(down)
+	if i := pickByWeight(up); i > 0 {
+		first := up[i]
+		copy(up[1:i+1], up[:i])
+		up[0] = first
+	}
+	return append(up, down...)
+}
+
+// byLatency sorts remotes by latency, with the ones not probed yet last.
+func byLatency(remotes []*remoteServer) {
+	latencies := make(map[*remoteServer]time.Duration, len(remotes))
+	for _, r := range remotes {
+		latencies[r] = r.getLatency()
+	}
+	sort.SliceStable(remotes, func(i, j int) bool {
+		a, b := latencies[remotes[i]], latencies[remotes[j]]
+		return a != 0 && (b == 0 || a < b)
+	})
+}
+
+func pickByWeight(remotes []*remoteServer) int {
+	total := 0
+	for _, r := range remotes {
+		total += r.weight
+	}
+	if total <= 0 {
+		return 0
+	}
+	n := rand.Intn(total)
+	for i, r := range remotes {
+		if n -= r.weight; n < 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+// watch probes the remotes every interval in the background until closed.
+func (s *remoteSet) watch(interval time.Duration) {
+	if interval <= 0 || len(s.remotes) == 0 {
+		return
+	}
+	go func() {
+		s.probe()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.probe()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// probe sends a GET request without a payload to the fetch handler of each
+// remote, which is up if it responds anything but a 5xx error.
+func (s *remoteSet) probe() {
+	var wg sync.WaitGroup
+	for _, r := range s.remotes {
+		wg.Add(1)
+		go func(r *remoteServer) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), remoteProbeTimeout)
+			defer cancel()
+			req, err := http.NewRequest("GET", r.endpoint("f").String(), nil)
+			if err != nil {
+				r.setDown(err)
+				return
+			}
+			start := time.Now()
+			resp, err := s.client.Do(req.WithContext(ctx))
+			if err != nil {
+				r.setDown(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 500 {
+				r.setDown(errors.Format("error response to probe: %s", resp.Status))
+				return
+			}
+			r.setUp(time.Since(start))
+		}(r)
+	}
+	wg.Wait()
+}
+
+// close stops probing and closes the multiplexed connections.
+func (s *remoteSet) close() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() { close(s.stop) })
+	for _, r := range s.remotes {
+		r.mux.close()
+	}
+}
+
+// remoteRules maps domains to the remotes or the groups of remotes to use.
+type remoteRules struct {
+	domains *domainTrie
+	targets map[string]string // remote or group names by rule
+}
+
+// loadRemoteRules reads a remote rule file, or returns no rules if the file
+// does not exist. Each non-empty line not starting with # is
+//     <remote or group name> <domain rule>...
+// where a domain rule is the same as in the direct list. A rule names one of
+// remotes or their groups, and the most specific rule matching a domain wins.
+func loadRemoteRules(file string, remotes []*remoteServer) (*remoteRules, error) {
+	rules := &remoteRules{
+		domains: newDomainTrie(),
+		targets: make(map[string]string),
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return rules, nil
+		}
+		return nil, errors.Wrap(err)
+	}
+	defer f.Close()
+	names := make(map[string]bool)
+	for _, r := range remotes {
+		names[r.name] = true
+		if r.group != "" {
+			names[r.group] = true
+		}
+	}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if !names[fields[0]] {
+			return nil, errors.Format("%s:%d: unknown remote or group %s", file, lineNum, fields[0])
+		}
+		if len(fields) < 2 {
+			return nil, errors.Format("%s:%d: missing domain: %s", file, lineNum, line)
+		}
+		for _, rule := range fields[1:] {
+			domain, exact, wildcard := parseDomainRule(rule)
+			if domain == "" {
+				return nil, errors.Format("%s:%d: invalid domain rule %s", file, lineNum, rule)
+			}
+			canonical := canonicalRule(domain, exact, wildcard)
+			if target, ok := rules.targets[canonical]; ok && target != fields[0] {
+				return nil, errors.Format("%s:%d: %s is already mapped to %s", file, lineNum, rule, target)
+			}
+			rules.domains.add(canonical)
+			rules.targets[canonical] = fields[0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return rules, nil
+}
+
+// match returns the remote or group name of the rule matching host, or an
+// empty string if none matches.
+func (r *remoteRules) match(host string) string {
+	if r == nil {
+		return ""
+	}
+	_, rule := r.domains.match(host)
+	return r.targets[rule]
+}
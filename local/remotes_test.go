@@ -0,0 +1,227 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"h12.io/egress/protocol"
+)
+
+func testRemoteSet(u *url.URL) *remoteSet {
+	return newRemoteSet([]*remoteServer{newRemoteServer("test", u, 1)}, http.DefaultClient, nil, nil, nil, 0, 0)
+}
+
+func TestRemoteFailover(t *testing.T) {
+	var status int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, err := protocol.UnmarshalDNSQuery(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		answer, _ := fakeDNSAnswer(query, net.ParseIP("8.8.8.8"))
+		protocol.MarshalDNSAnswer(answer, w)
+	}))
+	defer good.Close()
+	badURL, _ := url.Parse(bad.URL)
+	goodURL, _ := url.Parse(good.URL)
+	badRemote := newRemoteServer("bad", badURL, 1)
+	goodRemote := newRemoteServer("good", goodURL, 0) // never picked first
+	remotes := newRemoteSet([]*remoteServer{badRemote, goodRemote}, http.DefaultClient, nil, nil, nil, 0, 0)
+
+	atomic.StoreInt32(&status, http.StatusGatewayTimeout)
+	r := newResolver(remotes)
+	if _, _, err := r.lookupRemote(context.Background(), "example.com"); err == nil {
+		t.Fatal("expect a 504 response not retried through the other remote")
+	}
+	if badRemote.isDown() {
+		t.Fatal("expect a 504 response not counted against the remote")
+	}
+
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	r = newResolver(remotes)
+	ips, _, err := r.lookupRemote(context.Background(), "example.com")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("8.8.8.8")) {
+		t.Fatalf("expect the answer of the good remote, got %v, %v", ips, err)
+	}
+	if !badRemote.isDown() || goodRemote.isDown() {
+		t.Fatal("expect the bad remote down")
+	}
+	if c := remotes.candidates(); c[0] != goodRemote || c[1] != badRemote {
+		t.Fatalf("expect the remote down tried last, got %s, %s", c[0].name, c[1].name)
+	}
+
+	atomic.StoreInt32(&status, http.StatusNotFound)
+	remotes.probe()
+	if badRemote.isDown() || goodRemote.isDown() {
+		t.Fatal("expect both remotes up after probing")
+	}
+	if badRemote.getLatency() <= 0 || goodRemote.getLatency() <= 0 {
+		t.Fatal("expect the latency measured by probing")
+	}
+}
+
+func TestRemoteFetchFailover(t *testing.T) {
+	reset := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body.Read(make([]byte, 1))
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer reset.Close()
+	refused, _ := net.Listen("tcp", "127.0.0.1:0")
+	refused.Close()
+	var fetched int32
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetched, 1)
+		req, err := protocol.UnmarshalRequest(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		protocol.MarshalResponse(&http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        make(http.Header),
+			ContentLength: int64(len(body)),
+			Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		}, w, protocol.RequestVersion(r))
+	}))
+	defer good.Close()
+	goodURL, _ := url.Parse(good.URL)
+
+	for _, badURL := range []string{reset.URL, "http://" + refused.Addr().String()} {
+		u, _ := url.Parse(badURL)
+		badRemote := newRemoteServer("bad", u, 1)
+		goodRemote := newRemoteServer("good", goodURL, 0) // never picked first
+		f := &remoteFetcher{newRemoteSet([]*remoteServer{badRemote, goodRemote}, http.DefaultClient, nil, nil, nil, 0, 0)}
+
+		body := strings.Repeat("x", 64<<10)
+		req, _ := http.NewRequest("POST", "http://example.com/upload", ioutil.NopCloser(strings.NewReader(body)))
+		resp, err := f.fetch(req)
+		if err != nil {
+			t.Fatalf("expect failover from %s, got %v", badURL, err)
+		}
+		echo, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(echo) != body || !badRemote.isDown() {
+			t.Fatalf("expect the body sent to the good remote, got %d bytes", len(echo))
+		}
+
+		badRemote.setUp(0)
+		atomic.StoreInt32(&fetched, 0)
+		req, _ = http.NewRequest("POST", "http://example.com/upload", ioutil.NopCloser(strings.NewReader(body+strings.Repeat("x", maxReplayBody))))
+		if _, err := f.fetch(req); err == nil || atomic.LoadInt32(&fetched) != 0 {
+			t.Fatal("expect no failover of a body too large to replay")
+		}
+	}
+}
+
+func TestRemoteCandidates(t *testing.T) {
+	var remotes []*remoteServer
+	for _, name := range []string{"a", "b", "c", "d"} {
+		remotes = append(remotes, newRemoteServer(name, &url.URL{Scheme: "http", Host: name}, 1))
+	}
+	remotes[0].setDown(errDNSUnavailable)
+	remotes[1].setUp(300)
+	remotes[2].setUp(100)
+	s := newRemoteSet(remotes, nil, nil, nil, nil, 0, 0)
+	picked := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		c := s.candidates()
+		if len(c) != 4 || c[3].name != "a" {
+			t.Fatalf("expect the remote down last, got %v", c)
+		}
+		picked[c[0].name]++
+		rest := ""
+		for _, r := range c[1:3] {
+			rest += r.name
+		}
+		if expected := map[string]string{"b": "cd", "c": "bd", "d": "cb"}[c[0].name]; rest != expected {
+			t.Fatalf("expect %s after %s in the order of latency, got %s", expected, c[0].name, rest)
+		}
+	}
+	if picked["b"] == 0 || picked["c"] == 0 || picked["d"] == 0 {
+		t.Fatalf("expect every remote up picked first by weight, got %v", picked)
+	}
+}
+
+func TestRemoteRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remoterules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "remoterules")
+	var remotes []*remoteServer
+	for _, name := range []string{"appengine", "us1", "us2"} {
+		remotes = append(remotes, newRemoteServer(name, &url.URL{Scheme: "http", Host: name}, 1))
+	}
+	remotes[1].group, remotes[2].group = "us", "us"
+
+	ioutil.WriteFile(file, []byte(`
+# streaming
+us .netflix.com *.hulu.com
+us2 www.netflix.com
+`), 0600)
+	rules, err := loadRemoteRules(file, remotes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newRemoteSet(remotes, nil, nil, nil, nil, 0, 0)
+	s.rules = rules
+	for _, testcase := range []struct {
+		host     string
+		expected string
+	}{
+		{"netflix.com", "us1,us2"},
+		{"api.netflix.com:443", "us1,us2"},
+		{"www.netflix.com", "us2"},
+		{"hulu.com", "appengine,us1,us2"},
+		{"www.hulu.com", "us1,us2"},
+		{"example.com", "appengine,us1,us2"},
+	} {
+		names := make(map[string]bool)
+		for _, r := range s.candidatesFor(testcase.host) {
+			names[r.name] = true
+		}
+		for _, name := range []string{"appengine", "us1", "us2"} {
+			if names[name] != strings.Contains(testcase.expected, name) {
+				t.Fatalf("expect %s for %s, got %v", testcase.expected, testcase.host, names)
+			}
+		}
+	}
+
+	for _, testcase := range []struct {
+		content  string
+		expected string
+	}{
+		{"jp .example.jp\n", ":1: unknown remote or group jp"},
+		{"us\n", ":1: missing domain"},
+		{"us .netflix.com\nappengine .netflix.com\n", ":2: .netflix.com is already mapped to us"},
+	} {
+		ioutil.WriteFile(file, []byte(testcase.content), 0600)
+		if _, err := loadRemoteRules(file, remotes); err == nil || !strings.Contains(err.Error(), testcase.expected) {
+			t.Fatalf("expect error %q, got %v", testcase.expected, err)
+		}
+	}
+}
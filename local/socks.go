@@ -0,0 +1,251 @@
+package local
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"h12.io/errors"
+)
+
+const (
+	socksVersion  = 5
+	socksNoAuth   = 0
+	socksUserPass = 2
+	socksNoMethod = 0xff
+
+	socksCmdConnect = 1
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksSucceeded         = 0
+	socksGeneralFailure    = 1
+	socksNotAllowed        = 2
+	socksHostUnreachable   = 4
+	socksCmdNotSupported   = 7
+	socksAtypNotSupported  = 8
+	socksHandshakeTimeout  = 30 * time.Second
+	socksUserPassVersion   = 1
+	socksUserPassSucceeded = 0
+	socksUserPassFailed    = 1
+)
+
+// ServeSOCKS accepts SOCKS5 connections on ln and routes CONNECT commands
+// through the same connector as HTTP CONNECT requests. Username/password
+// authentication is required if user is not empty.
+func (e *Egress) ServeSOCKS(ln net.Listener, user, password string) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		go func() {
+			if err := e.serveSOCKS(conn, user, password); err != nil {
+				log.Print(err)
+			}
+		}()
+	}
+}
+
+func (e *Egress) serveSOCKS(conn net.Conn, user, password string) error {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	if err := socksAuth(conn, user, password); err != nil {
+		return err
+	}
+	host, err := socksReadRequest(conn)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	w := &socksResponseWriter{conn: conn, header: make(http.Header)}
+	err = e.connect(w, host)
+	if !w.replied {
+		w.reply(socksReplyCode(w.status))
+	}
+	return err
+}
+
+func socksAuth(conn net.Conn, user, password string) error {
+	var buf [2]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return errors.Wrap(err)
+	}
+	if buf[0] != socksVersion {
+		return errors.Format("unsupported SOCKS version %d", buf[0])
+	}
+	methods := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return errors.Wrap(err)
+	}
+	method := byte(socksNoAuth)
+	if user != "" {
+		method = socksUserPass
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		conn.Write([]byte{socksVersion, socksNoMethod})
+		return errors.New("no acceptable SOCKS authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return errors.Wrap(err)
+	}
+	if method == socksNoAuth {
+		return nil
+	}
+
+	// RFC 1929
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return errors.Wrap(err)
+	}
+	if buf[0] != socksUserPassVersion {
+		return errors.Format("unsupported SOCKS auth version %d", buf[0])
+	}
+	u := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, u); err != nil {
+		return errors.Wrap(err)
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return errors.Wrap(err)
+	}
+	p := make([]byte, buf[0])
+	if _, err := io.ReadFull(conn, p); err != nil {
+		return errors.Wrap(err)
+	}
+	if subtle.ConstantTimeCompare(u, []byte(user)) != 1 ||
+		subtle.ConstantTimeCompare(p, []byte(password)) != 1 {
+		conn.Write([]byte{socksUserPassVersion, socksUserPassFailed})
+		return errors.Format("SOCKS auth failed for user %q", u)
+	}
+	_, err := conn.Write([]byte{socksUserPassVersion, socksUserPassSucceeded})
+	return errors.Wrap(err)
+}
+
+func socksReadRequest(conn net.Conn) (string, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return "", errors.Wrap(err)
+	}
+	if buf[0] != socksVersion {
+		return "", errors.Format("unsupported SOCKS version %d", buf[0])
+	}
+	if buf[1] != socksCmdConnect {
+		writeSOCKSReply(conn, socksCmdNotSupported)
+		return "", errors.Format("unsupported SOCKS command %d", buf[1])
+	}
+	var host string
+	switch buf[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if buf[3] == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", errors.Wrap(err)
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return "", errors.Wrap(err)
+		}
+		domain := make([]byte, buf[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", errors.Wrap(err)
+		}
+		host = string(domain)
+	default:
+		writeSOCKSReply(conn, socksAtypNotSupported)
+		return "", errors.Format("unsupported SOCKS address type %d", buf[3])
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", errors.Wrap(err)
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+func writeSOCKSReply(w io.Writer, code byte) error {
+	// the bound address is not meaningful for a proxied connection
+	_, err := w.Write([]byte{socksVersion, code, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return errors.Wrap(err)
+}
+
+func socksReplyCode(status int) byte {
+	switch status {
+	case http.StatusForbidden:
+		return socksNotAllowed
+	case http.StatusGatewayTimeout, http.StatusBadGateway:
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
+
+// socksResponseWriter lets a connector written for HTTP CONNECT serve a SOCKS
+// client. The status line written to the hijacked connection is translated
+// into a SOCKS reply, and a status set by WriteHeader is only reported if the
+// connector gives up, so that the smart connector can still fall back to the
+// remote after the direct connection fails.
+type socksResponseWriter struct {
+	conn    net.Conn
+	header  http.Header
+	status  int
+	replied bool
+}
+
+func (w *socksResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *socksResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *socksResponseWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("cannot write a response body to a SOCKS client")
+}
+
+func (w *socksResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return &socksConn{w.conn, w}, nil, nil
+}
+
+func (w *socksResponseWriter) reply(code byte) error {
+	w.replied = true
+	return writeSOCKSReply(w.conn, code)
+}
+
+type socksConn struct {
+	net.Conn
+	w *socksResponseWriter
+}
+
+func (c *socksConn) Write(p []byte) (int, error) {
+	if c.w.replied {
+		return c.Conn.Write(p)
+	}
+	// the first write is the status line of the CONNECT response
+	status := http.StatusBadGateway
+	if fields := bytes.Fields(p); len(fields) > 1 {
+		if s, err := strconv.Atoi(string(fields[1])); err == nil {
+			status = s
+		}
+	}
+	if status == http.StatusOK {
+		if err := c.w.reply(socksSucceeded); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if err := c.w.reply(socksReplyCode(status)); err != nil {
+		return 0, err
+	}
+	return 0, errors.Format("SOCKS connection failed with status %d", status)
+}
@@ -0,0 +1,82 @@
+package local
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestSOCKS(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	e := &Egress{}
+	e.state.Store(&egressState{connector: &directConnector{}})
+	go e.ServeSOCKS(ln, "user", "pass")
+
+	dial := func(password string, req []byte) (net.Conn, []byte) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte{5, 1, 2})
+		conn.Write(append([]byte{1, 4}, append([]byte("user"), append([]byte{byte(len(password))}, password...)...)...))
+		conn.Write(req)
+		reply, _ := ioutil.ReadAll(io.LimitReader(conn, 2+2+10))
+		return conn, reply
+	}
+
+	tport := target.Addr().(*net.TCPAddr).Port
+	portBytes := []byte{byte(tport >> 8), byte(tport)}
+
+	conn, reply := dial("pass", append([]byte{5, 1, 0, 1, 127, 0, 0, 1}, portBytes...))
+	if !bytes.Equal(reply[:6], []byte{5, 2, 1, 0, 5, 0}) {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo failed: %q %v", buf, err)
+	}
+	conn.Close()
+
+	domain := []byte("localhost")
+	conn, reply = dial("pass", append(append([]byte{5, 1, 0, 3, byte(len(domain))}, domain...), portBytes...))
+	if !bytes.Equal(reply[:6], []byte{5, 2, 1, 0, 5, 0}) {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+	conn.Close()
+
+	conn, reply = dial("wrong", append([]byte{5, 1, 0, 1, 127, 0, 0, 1}, portBytes...))
+	if !bytes.Equal(reply, []byte{5, 2, 1, 1}) {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+	conn.Close()
+
+	closed := []byte{0, 1}
+	conn, reply = dial("pass", append([]byte{5, 1, 0, 4}, append(net.IPv6loopback, closed...)...))
+	if !bytes.Equal(reply[:6], []byte{5, 2, 1, 0, 5, socksHostUnreachable}) {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+	conn.Close()
+}
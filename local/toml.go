@@ -0,0 +1,153 @@
+package local
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+
+	"h12.io/errors"
+)
+
+// parseTOML parses a subset of TOML: tables with bare keys, and bare keys with
+// basic or literal strings, integers, booleans or single-line arrays of them.
+// fn is called with the full key of each value, e.g. "remote.url", and the
+// line number where it is set.
+func parseTOML(file string, r io.Reader, fn func(key string, value interface{}, lineNum int) error) error {
+	seen := make(map[string]bool)
+	table := ""
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			end := strings.Index(line, "]")
+			if strings.HasPrefix(line, "[[") || end < 0 || !isTOMLComment(line[end+1:]) {
+				return errors.Format("%s:%d: invalid table: %s", file, lineNum, line)
+			}
+			table = strings.TrimSpace(line[1:end])
+			if !isTOMLKey(table) {
+				return errors.Format("%s:%d: invalid table name: %s", file, lineNum, line)
+			}
+			if seen[table] {
+				return errors.Format("%s:%d: duplicate table %s", file, lineNum, table)
+			}
+			seen[table] = true
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return errors.Format("%s:%d: expect key = value: %s", file, lineNum, line)
+		}
+		key := strings.TrimSpace(line[:i])
+		if !isTOMLKey(key) || strings.Contains(key, ".") {
+			return errors.Format("%s:%d: invalid key: %s", file, lineNum, line)
+		}
+		if table != "" {
+			key = table + "." + key
+		}
+		if seen[key] {
+			return errors.Format("%s:%d: duplicate key %s", file, lineNum, key)
+		}
+		seen[key] = true
+		value, rest, err := parseTOMLValue(strings.TrimSpace(line[i+1:]))
+		if err == nil && !isTOMLComment(rest) {
+			err = errors.Format("unexpected %s", rest)
+		}
+		if err != nil {
+			return errors.Format("%s:%d: %s: %s", file, lineNum, key, err.Error())
+		}
+		if err := fn(key, value, lineNum); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
+// parseTOMLValue parses the value at the start of s, returning a string,
+// int64, bool or []interface{} and the rest of s.
+func parseTOMLValue(s string) (interface{}, string, error) {
+	switch {
+	case s == "":
+		return nil, "", errors.New("missing value")
+	case s[0] == '"':
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				v, err := strconv.Unquote(s[:i+1])
+				if err != nil {
+					return nil, "", errors.Format("invalid string %s", s[:i+1])
+				}
+				return v, s[i+1:], nil
+			}
+		}
+		return nil, "", errors.New("unterminated string")
+	case s[0] == '\'':
+		i := strings.IndexByte(s[1:], '\'')
+		if i < 0 {
+			return nil, "", errors.New("unterminated string")
+		}
+		return s[1 : i+1], s[i+2:], nil
+	case s[0] == '[':
+		a := []interface{}{}
+		s = strings.TrimSpace(s[1:])
+		for {
+			if strings.HasPrefix(s, "]") {
+				return a, s[1:], nil
+			}
+			v, rest, err := parseTOMLValue(s)
+			if err != nil {
+				return nil, "", err
+			}
+			a = append(a, v)
+			s = strings.TrimSpace(rest)
+			if strings.HasPrefix(s, ",") {
+				s = strings.TrimSpace(s[1:])
+			} else if !strings.HasPrefix(s, "]") {
+				return nil, "", errors.New("expect , or ] in array")
+			}
+		}
+	}
+	i := strings.IndexAny(s, " \t,]#")
+	if i < 0 {
+		i = len(s)
+	}
+	word, rest := s[:i], s[i:]
+	switch word {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+	n, err := strconv.ParseInt(strings.Replace(word, "_", "", -1), 0, 64)
+	if err != nil {
+		return nil, "", errors.Format("invalid value %s", word)
+	}
+	return n, rest, nil
+}
+
+func isTOMLKey(key string) bool {
+	for _, part := range strings.Split(key, ".") {
+		if part == "" {
+			return false
+		}
+		for _, c := range part {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isTOMLComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || strings.HasPrefix(s, "#")
+}
@@ -0,0 +1,103 @@
+package local
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestUpstreamProxy(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	e := &Egress{}
+	e.state.Store(&egressState{connector: &directConnector{}})
+	httpProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if user, password, ok := parseProxyAuth(req); !ok || user != "user" || password != "pass" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		e.ServeHTTP(w, req)
+	}))
+	defer httpProxy.Close()
+	socksProxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socksProxy.Close()
+	go e.ServeSOCKS(socksProxy, "user", "pass")
+
+	for _, testcase := range []struct {
+		url string
+		ok  bool
+	}{
+		{"http://user:pass@" + httpProxy.Listener.Addr().String(), true},
+		{"http://user:wrong@" + httpProxy.Listener.Addr().String(), false},
+		{"socks5://user:pass@" + socksProxy.Addr().String(), true},
+		{"socks5://user:wrong@" + socksProxy.Addr().String(), false},
+	} {
+		p, err := parseUpstreamProxy(testcase.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := newResolver(nil)
+		r.proxy = p
+		conn, err := r.dial(context.Background(), target.Addr().String(), time.Second)
+		if !testcase.ok {
+			if err == nil {
+				conn.Close()
+				t.Fatalf("expect error of wrong password through %s", testcase.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("fail to dial through %s: %v", testcase.url, err)
+		}
+		conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("echo failed through %s: %q %v", testcase.url, buf, err)
+		}
+		conn.Close()
+	}
+
+	remote := fakeConnectRemote(t)
+	defer remote.Close()
+	p, _ := parseUpstreamProxy("socks5://user:pass@" + socksProxy.Addr().String())
+	conn, resp, err := dialRemote(context.Background(), &url.URL{Scheme: "http", Host: remote.Addr().String(), Path: "/c"}, p, nil, nil, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("fail to dial the remote through the proxy: %v", err)
+	}
+	conn.Close()
+
+	for _, s := range []string{"https://proxy.example.com", "socks5://", "proxy.example.com:8080"} {
+		if _, err := parseUpstreamProxy(s); err == nil {
+			t.Fatalf("expect error of invalid proxy %q", s)
+		}
+	}
+}
+
+func parseProxyAuth(req *http.Request) (string, string, bool) {
+	r := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+	return r.BasicAuth()
+}
@@ -0,0 +1,547 @@
+// Package mux multiplexes streams over a single connection, so that many
+// CONNECT tunnels can share one long-lived connection to the remote.
+//
+// Every frame starts with a 9-byte header: type (1 byte), stream ID (4 bytes)
+// and payload length (4 bytes). Only the client opens streams, each with a
+// target host:port, which the server accepts or rejects. Each direction of a
+// stream has a flow-control window that the receiver replenishes as data is
+// consumed. The client sends pings to keep the connection alive and closes
+// it when the server stops responding.
+package mux // import "h12.io/egress/mux"
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"h12.io/errors"
+)
+
+const (
+	typeOpen byte = iota
+	typeOpenAck
+	typeData
+	typeWindow
+	typeFin
+	typeReset
+	typePing
+	typePong
+)
+
+const (
+	headerSize     = 9
+	maxFrameSize   = 16 * 1024
+	maxControlSize = 1024
+	window         = 256 * 1024
+	acceptBacklog  = 256
+)
+
+var (
+	ErrClosed  = errors.New("mux: session closed")
+	ErrTimeout = errors.New("mux: keepalive timeout")
+	ErrReset   = errors.New("mux: stream reset by peer")
+)
+
+// OpenError is returned by Open when the server rejects a stream. Status is
+// an HTTP status code describing the reason.
+type OpenError struct {
+	Status int
+	Msg    string
+}
+
+func (e *OpenError) Error() string {
+	return "mux: stream rejected: " + e.Msg
+}
+
+type Session struct {
+	conn      io.ReadWriteCloser
+	client    bool
+	keepAlive time.Duration
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+
+	writeMu  sync.Mutex
+	accept   chan *Stream
+	closed   chan struct{}
+	lastRecv int64
+}
+
+// Client starts the client side of a session. keepAlive is the ping interval,
+// and the session is closed if nothing is received in three intervals. Zero
+// disables keepalive.
+func Client(conn io.ReadWriteCloser, keepAlive time.Duration) *Session {
+	return newSession(conn, keepAlive, 1)
+}
+
+// Server starts the server side of a session.
+func Server(conn io.ReadWriteCloser, keepAlive time.Duration) *Session {
+	return newSession(conn, keepAlive, 0)
+}
+
+func newSession(conn io.ReadWriteCloser, keepAlive time.Duration, nextID uint32) *Session {
+	s := &Session{
+		conn:      conn,
+		client:    nextID != 0,
+		keepAlive: keepAlive,
+		streams:   make(map[uint32]*Stream),
+		nextID:    nextID,
+		accept:    make(chan *Stream, acceptBacklog),
+		closed:    make(chan struct{}),
+		lastRecv:  time.Now().UnixNano(),
+	}
+	go s.readLoop()
+	if keepAlive > 0 {
+		go s.keepAliveLoop()
+	}
+	return s
+}
+
+// Open opens a stream to target and waits until the server accepts it.
+func (s *Session) Open(target string, timeout time.Duration) (*Stream, error) {
+	if !s.client {
+		return nil, errors.New("mux: only the client can open streams")
+	}
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	st := newStream(s, s.nextID, target)
+	st.opened = make(chan error, 1)
+	s.nextID += 2
+	s.streams[st.id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(typeOpen, st.id, []byte(target)); err != nil {
+		s.remove(st.id)
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-st.opened:
+		if err != nil {
+			s.remove(st.id)
+			return nil, err
+		}
+		return st, nil
+	case <-timer.C:
+		st.Close()
+		return nil, errors.Format("mux: timeout opening stream to %s", target)
+	case <-s.closed:
+		return nil, s.Err()
+	}
+}
+
+// Accept returns the next stream opened by the client. The caller must call
+// Accept or Reject on the stream.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.closed:
+		return nil, s.Err()
+	}
+}
+
+func (s *Session) Close() error {
+	s.closeWith(ErrClosed)
+	return nil
+}
+
+// IsClosed returns true after the session is closed by either side.
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) closeWith(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	close(s.closed)
+	s.mu.Unlock()
+
+	s.conn.Close()
+	for _, st := range streams {
+		st.setReset(err)
+	}
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) writeFrame(typ byte, id uint32, payload []byte) error {
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:], id)
+	binary.BigEndian.PutUint32(buf[5:], uint32(len(payload)))
+	copy(buf[headerSize:], payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.IsClosed() {
+		return s.Err()
+	}
+	if _, err := s.conn.Write(buf); err != nil {
+		s.closeWith(errors.Wrap(err))
+		return s.Err()
+	}
+	return nil
+}
+
+func (s *Session) readLoop() {
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			s.closeWith(errors.Wrap(err))
+			return
+		}
+		typ := header[0]
+		id := binary.BigEndian.Uint32(header[1:])
+		size := binary.BigEndian.Uint32(header[5:])
+		if (typ == typeData && size > maxFrameSize) || (typ != typeData && size > maxControlSize) {
+			s.closeWith(errors.Format("mux: frame too large: %d", size))
+			return
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.closeWith(errors.Wrap(err))
+			return
+		}
+		atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+		if err := s.handle(typ, id, payload); err != nil {
+			s.closeWith(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handle(typ byte, id uint32, payload []byte) error {
+	switch typ {
+	case typeOpen:
+		if s.client || id%2 != 1 {
+			return errors.Format("mux: unexpected open of stream %d", id)
+		}
+		st := newStream(s, id, string(payload))
+		s.mu.Lock()
+		if _, ok := s.streams[id]; ok {
+			s.mu.Unlock()
+			return errors.Format("mux: duplicate stream %d", id)
+		}
+		s.streams[id] = st
+		s.mu.Unlock()
+		select {
+		case s.accept <- st:
+		default:
+			st.Reject(503, "too many pending streams")
+		}
+		return nil
+	case typePing:
+		go s.writeFrame(typePong, 0, payload)
+		return nil
+	case typePong:
+		return nil
+	}
+
+	st := s.stream(id)
+	if st == nil {
+		// frames may arrive for a stream that is already closed locally
+		return nil
+	}
+	switch typ {
+	case typeOpenAck:
+		st.mu.Lock()
+		st.acked = true
+		st.mu.Unlock()
+		if st.opened != nil {
+			select {
+			case st.opened <- nil:
+			default:
+			}
+		}
+	case typeReset:
+		s.remove(id)
+		st.mu.Lock()
+		acked := st.acked
+		st.mu.Unlock()
+		if st.opened != nil && !acked && len(payload) >= 2 {
+			select {
+			case st.opened <- &OpenError{
+				Status: int(binary.BigEndian.Uint16(payload)),
+				Msg:    string(payload[2:]),
+			}:
+			default:
+			}
+		}
+		st.setReset(ErrReset)
+	case typeData:
+		return st.pushData(payload)
+	case typeWindow:
+		if len(payload) != 4 {
+			return errors.New("mux: invalid window update")
+		}
+		st.addWindow(binary.BigEndian.Uint32(payload))
+	case typeFin:
+		st.setFin()
+	default:
+		return errors.Format("mux: unknown frame type %d", typ)
+	}
+	return nil
+}
+
+func (s *Session) keepAliveLoop() {
+	ticker := time.NewTicker(s.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, atomic.LoadInt64(&s.lastRecv))) > 3*s.keepAlive {
+				s.closeWith(ErrTimeout)
+				return
+			}
+			var payload [8]byte
+			binary.BigEndian.PutUint64(payload[:], uint64(now.UnixNano()))
+			// a blocked write must not stop the timeout check
+			go s.writeFrame(typePing, 0, payload[:])
+		}
+	}
+}
+
+// Stream is one bidirectional byte stream in a session.
+type Stream struct {
+	id     uint32
+	s      *Session
+	target string
+	opened chan error
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	buf        []byte
+	consumed   uint32
+	sendWindow uint32
+	acked      bool
+	recvFin    bool
+	sentFin    bool
+	closed     bool
+	err        error
+}
+
+func newStream(s *Session, id uint32, target string) *Stream {
+	st := &Stream{
+		id:         id,
+		s:          s,
+		target:     target,
+		sendWindow: window,
+	}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// Target returns the host:port the client asks to connect to.
+func (st *Stream) Target() string {
+	return st.target
+}
+
+// Accept confirms the stream to the client.
+func (st *Stream) Accept() error {
+	return st.s.writeFrame(typeOpenAck, st.id, nil)
+}
+
+// Reject refuses the stream with an HTTP status code and a message.
+func (st *Stream) Reject(status int, msg string) error {
+	st.s.remove(st.id)
+	st.setReset(ErrReset)
+	if len(msg) > maxControlSize-2 {
+		msg = msg[:maxControlSize-2]
+	}
+	payload := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(payload, uint16(status))
+	copy(payload[2:], msg)
+	return st.s.writeFrame(typeReset, st.id, payload)
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for len(st.buf) == 0 && !st.recvFin && st.err == nil && !st.closed {
+		st.cond.Wait()
+	}
+	if len(st.buf) == 0 {
+		defer st.mu.Unlock()
+		switch {
+		case st.err != nil:
+			return 0, st.err
+		case st.closed:
+			return 0, ErrClosed
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, st.buf)
+	st.buf = st.buf[n:]
+	st.consumed += uint32(n)
+	var inc uint32
+	if st.consumed >= window/2 {
+		inc, st.consumed = st.consumed, 0
+	}
+	st.mu.Unlock()
+
+	if inc > 0 {
+		var payload [4]byte
+		binary.BigEndian.PutUint32(payload[:], inc)
+		st.s.writeFrame(typeWindow, st.id, payload[:])
+	}
+	return n, nil
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		for st.sendWindow == 0 && st.err == nil && !st.closed && !st.sentFin {
+			st.cond.Wait()
+		}
+		switch {
+		case st.err != nil:
+			st.mu.Unlock()
+			return written, st.err
+		case st.closed || st.sentFin:
+			st.mu.Unlock()
+			return written, ErrClosed
+		}
+		n := len(p)
+		if n > int(st.sendWindow) {
+			n = int(st.sendWindow)
+		}
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+
+		if err := st.s.writeFrame(typeData, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer that no more data will be sent.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.sentFin || st.closed || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.sentFin = true
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	return st.s.writeFrame(typeFin, st.id, nil)
+}
+
+// Close closes both directions. The peer is reset if it may still send data.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	graceful := st.recvFin || st.err != nil
+	sentFin := st.sentFin
+	st.sentFin = true
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	st.s.remove(st.id)
+	switch {
+	case !graceful:
+		return st.s.writeFrame(typeReset, st.id, nil)
+	case !sentFin && st.err == nil:
+		return st.s.writeFrame(typeFin, st.id, nil)
+	}
+	return nil
+}
+
+func (st *Stream) pushData(p []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.recvFin {
+		return errors.Format("mux: data after fin on stream %d", st.id)
+	}
+	if len(st.buf)+len(p) > window {
+		return errors.Format("mux: flow control violated on stream %d", st.id)
+	}
+	if !st.closed {
+		st.buf = append(st.buf, p...)
+		st.cond.Broadcast()
+	}
+	return nil
+}
+
+func (st *Stream) addWindow(inc uint32) {
+	st.mu.Lock()
+	st.sendWindow += inc
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *Stream) setFin() {
+	st.mu.Lock()
+	st.recvFin = true
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *Stream) setReset(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	if st.opened != nil {
+		select {
+		case st.opened <- err:
+		default:
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package mux_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"h12.io/egress/mux"
+)
+
+func pair(t *testing.T) (*mux.Session, *mux.Session) {
+	c, s := net.Pipe()
+	return mux.Client(c, 0), mux.Server(s, 0)
+}
+
+// echo serves streams by echoing back, rejecting targets named "reject".
+func echo(srv *mux.Session) {
+	for {
+		st, err := srv.Accept()
+		if err != nil {
+			return
+		}
+		if st.Target() == "reject:1" {
+			st.Reject(403, "denied")
+			continue
+		}
+		st.Accept()
+		go func() {
+			io.Copy(st, st)
+			st.CloseWrite()
+			st.Close()
+		}()
+	}
+}
+
+func TestStreams(t *testing.T) {
+	cli, srv := pair(t)
+	defer cli.Close()
+	go echo(srv)
+
+	data := make([]byte, 3*1024*1024) // larger than the window
+	rand.Read(data)
+	done := make(chan error, 4)
+	for i := 0; i < cap(done); i++ {
+		go func() {
+			st, err := cli.Open("example.com:443", time.Second)
+			if err != nil {
+				done <- err
+				return
+			}
+			defer st.Close()
+			go func() {
+				st.Write(data)
+				st.CloseWrite()
+			}()
+			got, err := ioutil.ReadAll(st)
+			if err == nil && !bytes.Equal(got, data) {
+				t.Error("data mismatch")
+			}
+			done <- err
+		}()
+	}
+	for i := 0; i < cap(done); i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReject(t *testing.T) {
+	cli, srv := pair(t)
+	defer cli.Close()
+	go echo(srv)
+	_, err := cli.Open("reject:1", time.Second)
+	if e, ok := err.(*mux.OpenError); !ok || e.Status != 403 {
+		t.Fatalf("expect OpenError 403, got %v", err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	cli, srv := pair(t)
+	go echo(srv)
+	st, err := cli.Open("example.com:443", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+	if _, err := st.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expect error after the session is closed")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !cli.IsClosed() {
+		t.Fatal("client session is not closed")
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	c, s := net.Pipe()
+	cli := mux.Client(c, 10*time.Millisecond)
+	// a server that never reads
+	defer s.Close()
+	time.Sleep(100 * time.Millisecond)
+	if !cli.IsClosed() {
+		t.Fatal("client session is not closed by keepalive timeout")
+	}
+}
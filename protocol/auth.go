@@ -0,0 +1,149 @@
+package protocol
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"h12.io/errors"
+)
+
+// AuthHeader carries "<key id>:<unix time>:<nonce>:<signature>", where the
+// signature is an HMAC-SHA256 over the id, time, nonce, method, path and
+// Connect-Host header of the request.
+const AuthHeader = "Egress-Auth"
+
+var ErrAuth = errors.New("invalid authentication token")
+
+// LoadKeys reads a key file. Each non-empty line not starting with # holds a
+// key id and a key separated by white spaces. The order is kept so that a
+// client can use the first key.
+func LoadKeys(file string) ([]Key, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	defer f.Close()
+	var keys []Key
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.Contains(fields[0], ":") {
+			return nil, errors.Format("%s:%d: expect <id> <key>", file, lineNum)
+		}
+		keys = append(keys, Key{ID: fields[0], Secret: []byte(fields[1])})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	if len(keys) == 0 {
+		return nil, errors.Format("no key found in %s", file)
+	}
+	return keys, nil
+}
+
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Sign attaches an authentication token to the request.
+func (k *Key) Sign(req *http.Request) error {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return errors.Wrap(err)
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	n := hex.EncodeToString(nonce[:])
+	sig := signature(k.Secret, k.ID, ts, n, req)
+	req.Header.Set(AuthHeader, strings.Join([]string{k.ID, ts, n, sig}, ":"))
+	return nil
+}
+
+func signature(secret []byte, id, ts, nonce string, req *http.Request) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{
+		id,
+		ts,
+		nonce,
+		req.Method,
+		req.URL.Path,
+		req.Header.Get("Connect-Host"),
+	}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verifier checks authentication tokens. A token is accepted only within the
+// window around its timestamp and only once.
+type Verifier struct {
+	keys   map[string][]byte
+	window time.Duration
+	nonces map[string]time.Time
+	purged time.Time
+	mu     sync.Mutex
+}
+
+func NewVerifier(keys []Key, window time.Duration) *Verifier {
+	m := make(map[string][]byte)
+	for _, k := range keys {
+		m[k.ID] = k.Secret
+	}
+	return &Verifier{
+		keys:   m,
+		window: window,
+		nonces: make(map[string]time.Time),
+	}
+}
+
+func (v *Verifier) Verify(req *http.Request) error {
+	fields := strings.Split(req.Header.Get(AuthHeader), ":")
+	if len(fields) != 4 {
+		return ErrAuth
+	}
+	id, ts, nonce, sig := fields[0], fields[1], fields[2], fields[3]
+	secret, ok := v.keys[id]
+	if !ok {
+		return ErrAuth
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(secret, id, ts, nonce, req))) {
+		return ErrAuth
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrAuth
+	}
+	now := time.Now()
+	t := time.Unix(sec, 0)
+	if t.Before(now.Add(-v.window)) || t.After(now.Add(v.window)) {
+		return ErrAuth
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if now.Sub(v.purged) > v.window {
+		for n, exp := range v.nonces {
+			if now.After(exp) {
+				delete(v.nonces, n)
+			}
+		}
+		v.purged = now
+	}
+	nonce = id + ":" + nonce
+	if _, used := v.nonces[nonce]; used {
+		return ErrAuth
+	}
+	v.nonces[nonce] = t.Add(v.window)
+	return nil
+}
@@ -0,0 +1,41 @@
+package protocol_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"h12.io/egress/protocol"
+)
+
+func TestAuth(t *testing.T) {
+	key := protocol.Key{ID: "alice", Secret: []byte("s3cret")}
+	v := protocol.NewVerifier([]protocol.Key{key}, time.Minute)
+
+	req, _ := http.NewRequest("GET", "http://remote/c", nil)
+	req.Header.Set("Connect-Host", "example.com:443")
+	if err := v.Verify(req); err == nil {
+		t.Fatal("unsigned request is accepted")
+	}
+	if err := key.Sign(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(req); err == nil {
+		t.Fatal("replayed request is accepted")
+	}
+
+	key.Sign(req)
+	req.Header.Set("Connect-Host", "127.0.0.1:22")
+	if err := v.Verify(req); err == nil {
+		t.Fatal("modified request is accepted")
+	}
+
+	wrong := protocol.Key{ID: "alice", Secret: []byte("guess")}
+	wrong.Sign(req)
+	if err := v.Verify(req); err == nil {
+		t.Fatal("request signed by a wrong key is accepted")
+	}
+}
@@ -18,10 +18,14 @@ func Connect(w http.ResponseWriter, host string) error {
 		w.WriteHeader(http.StatusGatewayTimeout)
 		return errors.Wrap(err)
 	}
-	defer srv.Close()
-
 	log.Printf("Connected to %s", host)
+	return Tunnel(w, srv)
+}
 
+// Tunnel hijacks the connection of a CONNECT request, confirms it and binds it
+// to srv. srv is closed when the tunnel ends.
+func Tunnel(w http.ResponseWriter, srv io.ReadWriteCloser) error {
+	defer srv.Close()
 	cli, err := Hijack(w)
 	if err != nil {
 		return err
@@ -49,7 +53,9 @@ func Bind(cli, srv io.ReadWriteCloser) error {
 			srv.Close()
 			log.Printf("COPY ERROR: %s", err.Error())
 			errChan <- errors.Wrap(err)
+			return
 		}
+		closeWrite(srv)
 	}()
 	go func() {
 		defer wg.Done()
@@ -59,16 +65,29 @@ func Bind(cli, srv io.ReadWriteCloser) error {
 			srv.Close()
 			log.Printf("COPY ERROR: %s", err.Error())
 			errChan <- errors.Wrap(err)
+			return
 		}
+		closeWrite(cli)
 	}()
 	log.Print("binded")
 	wg.Wait()
+	close(errChan)
 	if err, hasErr := <-errChan; hasErr {
 		return err
 	}
 	return nil
 }
 
+// closeWrite passes EOF on to the other side if the connection supports half
+// close, e.g. TCP, TLS and multiplexed streams.
+func closeWrite(c io.ReadWriteCloser) {
+	if cw, ok := c.(interface {
+		CloseWrite() error
+	}); ok {
+		cw.CloseWrite()
+	}
+}
+
 func OK200(w io.Writer) error {
 	_, err := w.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
 	return errors.Wrap(err)
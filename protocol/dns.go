@@ -0,0 +1,69 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"h12.io/errors"
+)
+
+// DNSContentType is the media type of a DNS message in DNS-over-HTTPS (RFC
+// 8484).
+const DNSContentType = "application/dns-message"
+
+const maxDNSMessage = 65535
+
+// MarshalDNSQuery returns a POST request to the remote carrying the DNS query
+// msg in wire format.
+func MarshalDNSQuery(msg []byte, remote string) (*http.Request, error) {
+	var buf bytes.Buffer
+	if err := writeDNSMessage(&buf, msg); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", remote, &buf)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	req.Header.Set("Content-Type", DNSContentType)
+	return req, nil
+}
+
+// UnmarshalDNSQuery decodes the DNS query sent by MarshalDNSQuery.
+func UnmarshalDNSQuery(req *http.Request) ([]byte, error) {
+	return readDNSMessage(req.Body)
+}
+
+// MarshalDNSAnswer writes the DNS answer msg in wire format.
+func MarshalDNSAnswer(msg []byte, w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", DNSContentType)
+	return writeDNSMessage(w, msg)
+}
+
+// UnmarshalDNSAnswer decodes the DNS answer written by MarshalDNSAnswer.
+func UnmarshalDNSAnswer(resp *http.Response) ([]byte, error) {
+	return readDNSMessage(resp.Body)
+}
+
+func writeDNSMessage(w io.Writer, msg []byte) error {
+	wc := NewWriter(w)
+	if _, err := wc.Write(msg); err != nil {
+		wc.Close()
+		return errors.Wrap(err)
+	}
+	return errors.Wrap(wc.Close())
+}
+
+func readDNSMessage(r io.Reader) ([]byte, error) {
+	rc := NewReader(r)
+	defer rc.Close()
+	msg, err := ioutil.ReadAll(io.LimitReader(rc, maxDNSMessage+1))
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	if len(msg) > maxDNSMessage {
+		return nil, errors.New("DNS message too large")
+	}
+	return msg, nil
+}
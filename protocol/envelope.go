@@ -0,0 +1,202 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"h12.io/errors"
+)
+
+// Version is the latest fetch protocol version. The local sends it in
+// VersionHeader of the request and the remote answers with the highest version
+// both sides support in VersionHeader of the response. A peer without the
+// header speaks version 1, where the response header is JSON encoded in the
+// egress-remote-header HTTP header and followed by the raw body.
+//
+// Since version 2, the response body is an envelope of frames, each with a
+// type (1 byte), a payload length (4 bytes) and the payload: one header frame
+// with the JSON encoded Header, data frames of the body, one trailer frame
+// with the JSON encoded trailers and finally an end frame, so that a
+// truncated body can be told from a complete one.
+const (
+	Version       = 2
+	VersionHeader = "Egress-Version"
+)
+
+const (
+	frameHeader byte = iota + 1
+	frameData
+	frameTrailer
+	frameEnd
+)
+
+const (
+	maxMetaFrameSize = 1 << 20
+	dataFrameSize    = 32 * 1024
+)
+
+// RequestVersion returns the protocol version to respond with.
+func RequestVersion(req *http.Request) int {
+	v, err := strconv.Atoi(req.Header.Get(VersionHeader))
+	if err != nil || v < 1 {
+		return 1
+	}
+	if v > Version {
+		return Version
+	}
+	return v
+}
+
+func writeFrame(w io.Writer, typ byte, payload []byte) error {
+	var header [5]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return errors.Wrap(err)
+	}
+	_, err := w.Write(payload)
+	return errors.Wrap(err)
+}
+
+func writeEnvelope(w http.ResponseWriter, resp *http.Response) error {
+	buf, err := json.Marshal(newHeader(resp))
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	if err := writeFrame(w, frameHeader, buf); err != nil {
+		return err
+	}
+	flusher, _ := w.(http.Flusher)
+	data := make([]byte, dataFrameSize)
+	for {
+		n, err := resp.Body.Read(data)
+		if n > 0 {
+			if err := writeFrame(w, frameData, data[:n]); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err)
+		}
+	}
+	// trailers are only available after the body is read
+	if len(resp.Trailer) > 0 {
+		buf, err := json.Marshal(resp.Trailer)
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		if err := writeFrame(w, frameTrailer, buf); err != nil {
+			return err
+		}
+	}
+	return writeFrame(w, frameEnd, nil)
+}
+
+func readFrameHeader(r io.Reader) (byte, uint32, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, errors.Wrap(err)
+	}
+	return header[0], binary.BigEndian.Uint32(header[1:]), nil
+}
+
+func readMetaFrame(r io.Reader, size uint32, v interface{}) error {
+	if size > maxMetaFrameSize {
+		return errors.Format("frame too large: %d", size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return errors.Wrap(err)
+	}
+	return errors.Wrap(json.Unmarshal(buf, v))
+}
+
+func readEnvelope(body io.ReadCloser) (*http.Response, error) {
+	r := bufio.NewReader(body)
+	typ, size, err := readFrameHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if typ != frameHeader {
+		return nil, errors.Format("expect header frame, got %d", typ)
+	}
+	var h Header
+	if err := readMetaFrame(r, size, &h); err != nil {
+		return nil, err
+	}
+	resp := h.response(nil)
+	resp.Body = &envelopeReader{r: r, c: body, resp: resp}
+	return resp, nil
+}
+
+type envelopeReader struct {
+	r      *bufio.Reader
+	c      io.Closer
+	resp   *http.Response
+	remain uint32
+	err    error
+}
+
+func (e *envelopeReader) Read(p []byte) (int, error) {
+	for e.remain == 0 {
+		if e.err != nil {
+			return 0, e.err
+		}
+		e.err = e.next()
+	}
+	if uint32(len(p)) > e.remain {
+		p = p[:e.remain]
+	}
+	n, err := e.r.Read(p)
+	e.remain -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		e.err = errors.Wrap(err)
+	}
+	return n, e.err
+}
+
+func (e *envelopeReader) next() error {
+	typ, size, err := readFrameHeader(e.r)
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case frameData:
+		e.remain = size
+		return nil
+	case frameTrailer:
+		var trailer http.Header
+		if err := readMetaFrame(e.r, size, &trailer); err != nil {
+			return err
+		}
+		if e.resp.Trailer == nil {
+			e.resp.Trailer = make(http.Header)
+		}
+		for k, v := range trailer {
+			e.resp.Trailer[k] = v
+		}
+		return nil
+	case frameEnd:
+		return io.EOF
+	}
+	return errors.Format("unknown frame type %d", typ)
+}
+
+func (e *envelopeReader) Close() error {
+	return e.c.Close()
+}
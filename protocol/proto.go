@@ -2,9 +2,9 @@ package protocol // import "h12.io/egress/protocol"
 
 import (
 	"bufio"
-	"bytes"
 	"io"
 	"net/http"
+	"strconv"
 
 	"encoding/json"
 	"h12.io/errors"
@@ -15,20 +15,33 @@ var (
 	NewReader = func(r io.Reader) io.ReadCloser { return nopReadCloser{r} }
 )
 
+// MarshalRequest returns a POST request to the remote, whose body streams the
+// encoded req while it is being sent, so that the request body of req is
+// never held in memory as a whole. The body has no known length and is sent
+// with chunked transfer encoding.
 func MarshalRequest(req *http.Request, remote string) (*http.Request, error) {
-	var buf bytes.Buffer
-	wc := NewWriter(&buf)
-	if err := req.WriteProxy(wc); err != nil {
-		wc.Close()
-		return nil, errors.Wrap(err)
-	}
-	if err := wc.Close(); err != nil {
+	ret, err := http.NewRequest("POST", remote, nil)
+	if err != nil {
 		return nil, errors.Wrap(err)
 	}
-	ret, err := http.NewRequest("POST", remote, &buf)
-	return ret, errors.Wrap(err)
+	pr, pw := io.Pipe()
+	go func() {
+		wc := NewWriter(pw)
+		if err := req.WriteProxy(wc); err != nil {
+			wc.Close()
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(wc.Close())
+	}()
+	ret.Body = pr
+	ret.ContentLength = -1
+	ret.Header.Set(VersionHeader, strconv.Itoa(Version))
+	return ret, nil
 }
 
+// UnmarshalRequest decodes the request sent by MarshalRequest. The body of the
+// returned request streams from the body of req.
 func UnmarshalRequest(req *http.Request) (*http.Request, error) {
 	rc := NewReader(req.Body)
 	ret, err := http.ReadRequest(bufio.NewReader(rc))
@@ -36,29 +49,75 @@ func UnmarshalRequest(req *http.Request) (*http.Request, error) {
 		rc.Close()
 		return nil, errors.Wrap(err)
 	}
-	return ret, errors.Wrap(rc.Close())
+	if ret.Body == http.NoBody {
+		return ret, errors.Wrap(rc.Close())
+	}
+	ret.Body = &chainCloser{ret.Body, rc}
+	return ret, nil
 }
 
 type Header struct {
-	Status        string
-	StatusCode    int
-	Proto         string
-	ProtoMajor    int
-	ProtoMinor    int
-	Header        http.Header
-	ContentLength int64
+	Status           string
+	StatusCode       int
+	Proto            string
+	ProtoMajor       int
+	ProtoMinor       int
+	Header           http.Header
+	ContentLength    int64
+	TransferEncoding []string    `json:",omitempty"`
+	Close            bool        `json:",omitempty"`
+	Uncompressed     bool        `json:",omitempty"`
+	Trailer          http.Header `json:",omitempty"` // keys only
+}
+
+func newHeader(resp *http.Response) *Header {
+	var trailer http.Header
+	if len(resp.Trailer) > 0 {
+		trailer = make(http.Header)
+		for k := range resp.Trailer {
+			trailer[k] = nil
+		}
+	}
+	return &Header{
+		Status:           resp.Status,
+		StatusCode:       resp.StatusCode,
+		Proto:            resp.Proto,
+		ProtoMajor:       resp.ProtoMajor,
+		ProtoMinor:       resp.ProtoMinor,
+		Header:           resp.Header,
+		ContentLength:    resp.ContentLength,
+		TransferEncoding: resp.TransferEncoding,
+		Close:            resp.Close,
+		Uncompressed:     resp.Uncompressed,
+		Trailer:          trailer,
+	}
+}
+
+func (h *Header) response(body io.ReadCloser) *http.Response {
+	return &http.Response{
+		Status:           h.Status,
+		StatusCode:       h.StatusCode,
+		Proto:            h.Proto,
+		ProtoMajor:       h.ProtoMajor,
+		ProtoMinor:       h.ProtoMinor,
+		Header:           h.Header,
+		ContentLength:    h.ContentLength,
+		TransferEncoding: h.TransferEncoding,
+		Close:            h.Close,
+		Uncompressed:     h.Uncompressed,
+		Trailer:          h.Trailer,
+		Body:             body,
+	}
 }
 
-func MarshalResponse(resp *http.Response, w http.ResponseWriter) error {
-	buf, err := json.Marshal(Header{
-		Status:        resp.Status,
-		StatusCode:    resp.StatusCode,
-		Proto:         resp.Proto,
-		ProtoMajor:    resp.ProtoMajor,
-		ProtoMinor:    resp.ProtoMinor,
-		Header:        resp.Header,
-		ContentLength: resp.ContentLength,
-	})
+// MarshalResponse writes resp in the format of the given protocol version,
+// which should be the result of RequestVersion.
+func MarshalResponse(resp *http.Response, w http.ResponseWriter, version int) error {
+	if version >= 2 {
+		w.Header().Set(VersionHeader, "2")
+		return writeEnvelope(w, resp)
+	}
+	buf, err := json.Marshal(newHeader(resp))
 	if err != nil {
 		return errors.Wrap(err)
 	}
@@ -68,21 +127,28 @@ func MarshalResponse(resp *http.Response, w http.ResponseWriter) error {
 }
 
 func UnmarshalResponse(resp *http.Response, req *http.Request) (*http.Response, error) {
+	if resp.Header.Get(VersionHeader) == "2" {
+		return readEnvelope(resp.Body)
+	}
 	var h Header
 	err := json.Unmarshal([]byte(resp.Header.Get("egress-remote-header")), &h)
 	if err != nil {
 		return nil, errors.Wrap(err)
 	}
-	return &http.Response{
-		Status:        h.Status,
-		StatusCode:    h.StatusCode,
-		Proto:         h.Proto,
-		ProtoMajor:    h.ProtoMajor,
-		ProtoMinor:    h.ProtoMinor,
-		Header:        h.Header,
-		ContentLength: h.ContentLength,
-		Body:          resp.Body,
-	}, nil
+	return h.response(resp.Body), nil
+}
+
+type chainCloser struct {
+	io.ReadCloser
+	c io.Closer
+}
+
+func (c *chainCloser) Close() error {
+	err := c.ReadCloser.Close()
+	if cerr := c.c.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 type nopReadCloser struct {
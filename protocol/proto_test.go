@@ -0,0 +1,150 @@
+package protocol_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"h12.io/egress/protocol"
+)
+
+func TestStreamRequest(t *testing.T) {
+	data := make([]byte, 4*1024*1024)
+	rand.Read(data)
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest("PUT", "http://example.com/upload", pr)
+	req.ContentLength = int64(len(data))
+
+	marshaled, err := protocol.MarshalRequest(req, "http://remote/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marshaled.ContentLength != -1 {
+		t.Fatalf("expect unknown length, got %d", marshaled.ContentLength)
+	}
+	// the upload is still in progress while the remote starts reading
+	go func() {
+		pw.Write(data)
+		pw.Close()
+	}()
+	unmarshaled, err := protocol.UnmarshalRequest(marshaled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unmarshaled.ContentLength != int64(len(data)) {
+		t.Fatalf("expect length %d, got %d", len(data), unmarshaled.ContentLength)
+	}
+	body, err := ioutil.ReadAll(unmarshaled.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, data) {
+		t.Fatal("body mismatch")
+	}
+	unmarshaled.Body.Close()
+}
+
+func TestStreamRequestNoBody(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	marshaled, err := protocol.MarshalRequest(req, "http://remote/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshaled, err := protocol.UnmarshalRequest(marshaled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unmarshaled.Body != http.NoBody {
+		t.Fatal("expect no body")
+	}
+}
+
+func TestResponseEnvelope(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		resp := &http.Response{
+			Status:           "200 OK",
+			StatusCode:       200,
+			Proto:            "HTTP/1.1",
+			ProtoMajor:       1,
+			ProtoMinor:       1,
+			Header:           http.Header{"Content-Type": {"text/plain"}},
+			ContentLength:    -1,
+			TransferEncoding: []string{"chunked"},
+			Close:            true,
+			Trailer:          http.Header{"Checksum": nil},
+			Body:             ioutil.NopCloser(bytes.NewReader(make([]byte, 100000))),
+		}
+		// trailer values are only known after the body is read
+		resp.Body = &trailerSetter{resp.Body, resp}
+		rec := httptest.NewRecorder()
+		if err := protocol.MarshalResponse(resp, rec, version); err != nil {
+			t.Fatal(err)
+		}
+		remoteResp := rec.Result()
+		got, err := protocol.UnmarshalResponse(remoteResp, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(got.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(body) != 100000 || got.StatusCode != 200 || got.Header.Get("Content-Type") != "text/plain" {
+			t.Fatalf("v%d: response mismatch: %d %v", version, len(body), got.Header)
+		}
+		if version == 2 {
+			if !got.Close || len(got.TransferEncoding) != 1 || got.Trailer.Get("Checksum") != "abc" {
+				t.Fatalf("v2: metadata mismatch: %v %v %v", got.Close, got.TransferEncoding, got.Trailer)
+			}
+		}
+	}
+}
+
+func TestResponseEnvelopeTruncated(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(bytes.NewReader(make([]byte, 1000))),
+	}
+	rec := httptest.NewRecorder()
+	protocol.MarshalResponse(resp, rec, 2)
+	remoteResp := rec.Result()
+	data, _ := ioutil.ReadAll(remoteResp.Body)
+	remoteResp.Body = ioutil.NopCloser(bytes.NewReader(data[:len(data)-5]))
+	got, err := protocol.UnmarshalResponse(remoteResp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(got.Body); err == nil {
+		t.Fatal("truncated body is not detected")
+	}
+}
+
+func TestRequestVersion(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	marshaled, _ := protocol.MarshalRequest(req, "http://remote/f")
+	if v := protocol.RequestVersion(marshaled); v != protocol.Version {
+		t.Fatalf("expect version %d, got %d", protocol.Version, v)
+	}
+	old, _ := http.NewRequest("POST", "http://remote/f", nil)
+	if v := protocol.RequestVersion(old); v != 1 {
+		t.Fatalf("expect version 1, got %d", v)
+	}
+}
+
+type trailerSetter struct {
+	io.ReadCloser
+	resp *http.Response
+}
+
+func (t *trailerSetter) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if err == io.EOF {
+		t.resp.Trailer.Set("Checksum", "abc")
+	}
+	return n, err
+}
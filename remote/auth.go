@@ -0,0 +1,19 @@
+package remote
+
+import (
+	"net/http"
+
+	"h12.io/egress/protocol"
+)
+
+// Authenticate rejects requests without a valid token with 403.
+func Authenticate(v *protocol.Verifier, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := v.Verify(r); err != nil {
+			NewContext(r).Errorf("unauthenticated request from %s: %s", r.RemoteAddr, err.Error())
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -20,10 +20,10 @@ func NewContext(r *http.Request) *Context {
 func (ctx *Context) NewClient() *http.Client {
 	return &http.Client{
 		Transport: &http.Transport{
-			Dial: (&net.Dialer{
+			Dial: DefaultPolicy.Dial((&net.Dialer{
 				Timeout:   10 * time.Second,
 				KeepAlive: 30 * time.Second,
-			}).Dial,
+			}).Dial),
 			TLSHandshakeTimeout: 10 * time.Second,
 		}}
 }
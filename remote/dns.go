@@ -0,0 +1,55 @@
+package remote
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"h12.io/egress/protocol"
+)
+
+// DNSUpstream is the DNS-over-HTTPS resolver that ServeDNS forwards queries
+// to.
+var DNSUpstream = "https://dns.google/dns-query"
+
+// ServeDNS resolves a DNS query from the local egress with DNSUpstream, so
+// that the local egress gets answers that are not forged on the way.
+func ServeDNS(w http.ResponseWriter, r *http.Request) {
+	ctx := NewContext(r)
+	query, err := protocol.UnmarshalDNSQuery(r)
+	if err != nil {
+		ctx.Errorf("fail to unmarshal a DNS query: %s", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req, err := http.NewRequest("POST", DNSUpstream, bytes.NewReader(query))
+	if err != nil {
+		ctx.Errorf("invalid DNS upstream %s: %s", DNSUpstream, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", protocol.DNSContentType)
+	req.Header.Set("Accept", protocol.DNSContentType)
+	resp, err := ctx.NewClient().Do(req)
+	if err != nil {
+		ctx.Errorf("fail to resolve: %v", err)
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		ctx.Errorf("error response from DNS upstream: %s", resp.Status)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	answer, err := ioutil.ReadAll(io.LimitReader(resp.Body, 65536))
+	if err != nil {
+		ctx.Errorf("fail to read DNS answer: %s", err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if err := protocol.MarshalDNSAnswer(answer, w); err != nil {
+		ctx.Errorf("fail to marshal a DNS answer: %s", err.Error())
+	}
+}
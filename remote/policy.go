@@ -0,0 +1,248 @@
+package remote
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"h12.io/errors"
+)
+
+// DefaultPolicy is the destination policy enforced by ServeFetch and
+// ServeConnect.
+var DefaultPolicy = NewPolicy()
+
+var ErrDenied = errors.New("destination denied by policy")
+
+// Policy decides which destinations the remote is allowed to reach.
+//
+// Domains match themselves and their subdomains. A denied domain or port is
+// always denied, and when an allow list of domains or ports is not empty, only
+// the listed ones are allowed, so an IP literal is then allowed only in an
+// allowed network. Resolved IP addresses in a denied network are
+// denied, then those in an allowed network are allowed, then those in the
+// private ranges (loopback, RFC1918, link-local including the cloud metadata
+// address, etc.) are denied unless AllowPrivate is set.
+type Policy struct {
+	AllowNets    []*net.IPNet
+	DenyNets     []*net.IPNet
+	AllowDomains []string
+	DenyDomains  []string
+	AllowPorts   map[int]bool
+	DenyPorts    map[int]bool
+	AllowPrivate bool
+}
+
+var privateNets = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+func NewPolicy() *Policy {
+	return &Policy{
+		AllowPorts: make(map[int]bool),
+		DenyPorts:  make(map[int]bool),
+	}
+}
+
+// LoadPolicy reads a policy file. Each non-empty line not starting with #
+// is one of:
+//     allow|deny net <CIDR>
+//     allow|deny domain <domain>
+//     allow|deny port <port>
+//     allow private
+func LoadPolicy(file string) (*Policy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	defer f.Close()
+	p := NewPolicy()
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := p.parseRule(strings.Fields(line)); err != nil {
+			return nil, errors.Format("%s:%d: %s", file, lineNum, err.Error())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return p, nil
+}
+
+func (p *Policy) parseRule(fields []string) error {
+	if len(fields) == 2 && fields[0] == "allow" && fields[1] == "private" {
+		p.AllowPrivate = true
+		return nil
+	}
+	if len(fields) != 3 || (fields[0] != "allow" && fields[0] != "deny") {
+		return errors.New("expect allow|deny net|domain|port <value>")
+	}
+	allow := fields[0] == "allow"
+	switch fields[1] {
+	case "net":
+		_, n, err := net.ParseCIDR(fields[2])
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		if allow {
+			p.AllowNets = append(p.AllowNets, n)
+		} else {
+			p.DenyNets = append(p.DenyNets, n)
+		}
+	case "domain":
+		d := normalizeDomain(fields[2])
+		if allow {
+			p.AllowDomains = append(p.AllowDomains, d)
+		} else {
+			p.DenyDomains = append(p.DenyDomains, d)
+		}
+	case "port":
+		port, err := strconv.Atoi(fields[2])
+		if err != nil || port <= 0 || port > 65535 {
+			return errors.Format("invalid port %s", fields[2])
+		}
+		if allow {
+			p.AllowPorts[port] = true
+		} else {
+			p.DenyPorts[port] = true
+		}
+	default:
+		return errors.Format("unknown rule type %s", fields[1])
+	}
+	return nil
+}
+
+func normalizeDomain(d string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(d), "."), ".")
+}
+
+func matchDomain(host string, domains []string) bool {
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckHost checks the domain and port of host:port before resolution.
+func (p *Policy) CheckHost(hostPort string) error {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return errors.Format("invalid port %s", portStr)
+	}
+	if p.DenyPorts[port] || (len(p.AllowPorts) > 0 && !p.AllowPorts[port]) {
+		return ErrDenied
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if len(p.AllowDomains) > 0 && !containsIP(p.AllowNets, normalizeIP(ip)) {
+			return ErrDenied
+		}
+		return p.CheckIP(ip)
+	}
+	host = normalizeDomain(host)
+	if matchDomain(host, p.DenyDomains) {
+		return ErrDenied
+	}
+	if len(p.AllowDomains) > 0 && !matchDomain(host, p.AllowDomains) {
+		return ErrDenied
+	}
+	return nil
+}
+
+func (p *Policy) CheckIP(ip net.IP) error {
+	ip = normalizeIP(ip)
+	if containsIP(p.DenyNets, ip) {
+		return ErrDenied
+	}
+	if containsIP(p.AllowNets, ip) {
+		return nil
+	}
+	if !p.AllowPrivate && containsIP(privateNets, ip) {
+		return ErrDenied
+	}
+	return nil
+}
+
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve checks host:port and returns the first allowed resolved address, so
+// that the address checked is the address dialed.
+func (p *Policy) Resolve(hostPort string) (string, error) {
+	if err := p.CheckHost(hostPort); err != nil {
+		return "", err
+	}
+	host, port, _ := net.SplitHostPort(hostPort)
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+	for _, ip := range ips {
+		if p.CheckIP(ip) == nil {
+			return net.JoinHostPort(ip.String(), port), nil
+		}
+	}
+	return "", ErrDenied
+}
+
+// Dial wraps dial so that only allowed destinations are dialed.
+func (p *Policy) Dial(dial func(network, addr string) (net.Conn, error)) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		resolved, err := p.Resolve(addr)
+		if err != nil {
+			return nil, err
+		}
+		return dial(network, resolved)
+	}
+}
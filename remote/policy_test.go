@@ -0,0 +1,160 @@
+// +build !appengine
+
+package remote_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"h12.io/egress/protocol"
+	"h12.io/egress/remote"
+)
+
+func stubListener(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+	return ln
+}
+
+func withPolicy(p *remote.Policy) func() {
+	saved := remote.DefaultPolicy
+	remote.DefaultPolicy = p
+	return func() { remote.DefaultPolicy = saved }
+}
+
+func connectStatus(t *testing.T, host string) int {
+	srv := httptest.NewServer(http.HandlerFunc(remote.ServeConnect))
+	defer srv.Close()
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Connect-Host", host)
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req.Write(conn)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestConnectPolicy(t *testing.T) {
+	ln := stubListener(t)
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	defer withPolicy(remote.NewPolicy())()
+	for _, host := range []string{ln.Addr().String(), "localhost:" + port, "[::1]:" + port} {
+		if status := connectStatus(t, host); status != http.StatusForbidden {
+			t.Fatalf("%s: expect 403, got %d", host, status)
+		}
+	}
+
+	remote.DefaultPolicy = loadPolicy(t, "allow net 127.0.0.0/8\n")
+	if status := connectStatus(t, ln.Addr().String()); status != http.StatusOK {
+		t.Fatalf("expect 200, got %d", status)
+	}
+}
+
+func TestFetchPolicy(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+	srv := httptest.NewServer(http.HandlerFunc(remote.ServeFetch))
+	defer srv.Close()
+	fetch := func(u string) int {
+		req, _ := http.NewRequest("GET", u, nil)
+		marshaled, err := protocol.MarshalRequest(req, srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(marshaled)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+
+	defer withPolicy(remote.NewPolicy())()
+	if status := fetch(target.URL); status != http.StatusForbidden {
+		t.Fatalf("expect 403, got %d", status)
+	}
+	// denied after resolution
+	if status := fetch("http://localhost:" + port); status == http.StatusOK {
+		t.Fatalf("localhost is not denied")
+	}
+
+	remote.DefaultPolicy = loadPolicy(t, "allow net 127.0.0.0/8\nallow net ::1/128\n")
+	if status := fetch(target.URL); status != http.StatusOK {
+		t.Fatalf("expect 200, got %d", status)
+	}
+	remote.DefaultPolicy = loadPolicy(t, "allow private\ndeny port "+port+"\n")
+	if status := fetch(target.URL); status != http.StatusForbidden {
+		t.Fatalf("expect 403, got %d", status)
+	}
+	remote.DefaultPolicy = loadPolicy(t, "allow private\ndeny domain localhost\n")
+	if status := fetch("http://localhost:" + port); status != http.StatusForbidden {
+		t.Fatalf("expect 403, got %d", status)
+	}
+	// an IP literal is not in the allowed domains
+	remote.DefaultPolicy = loadPolicy(t, "allow private\nallow domain localhost\n")
+	if status := fetch(target.URL); status != http.StatusForbidden {
+		t.Fatalf("expect 403 for an IP literal, got %d", status)
+	}
+	if status := fetch("http://localhost:" + port); status != http.StatusOK {
+		t.Fatalf("expect 200, got %d", status)
+	}
+	remote.DefaultPolicy = loadPolicy(t, "allow domain localhost\nallow net 127.0.0.0/8\nallow net ::1/128\n")
+	if status := fetch(target.URL); status != http.StatusOK {
+		t.Fatalf("expect 200 for an IP literal in an allowed network, got %d", status)
+	}
+}
+
+func loadPolicy(t *testing.T, rules string) *remote.Policy {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "policy")
+	ioutil.WriteFile(file, []byte(rules), 0600)
+	p, err := remote.LoadPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadPolicyError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "policy")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "policy")
+	ioutil.WriteFile(file, []byte("allow net 10.0.0.0/8\nallow nets x\n"), 0600)
+	if _, err := remote.LoadPolicy(file); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Fatalf("expect error at line 2, got %v", err)
+	}
+}
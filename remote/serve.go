@@ -1,7 +1,9 @@
 package remote
 
 import (
+	"net"
 	"net/http"
+	"net/url"
 
 	"h12.io/egress/protocol"
 )
@@ -16,6 +18,11 @@ func ServeFetch(w http.ResponseWriter, r *http.Request) {
 	}
 	defer req.Body.Close()
 	ctx.Infof("request: %v", req.URL)
+	if err := DefaultPolicy.CheckHost(hostPort(req.URL)); err != nil {
+		ctx.Errorf("fail to fetch %v: %v", req.URL, err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 	// a proxy should use Transport directly to avoid automatic redirection and
 	// return the response as long as it is not nil.
 	resp, err := ctx.NewClient().Transport.RoundTrip(req)
@@ -26,7 +33,7 @@ func ServeFetch(w http.ResponseWriter, r *http.Request) {
 	}
 	defer resp.Body.Close()
 	ctx.Infof("respond: %v", resp.StatusCode)
-	if err := protocol.MarshalResponse(resp, w); err != nil {
+	if err := protocol.MarshalResponse(resp, w, protocol.RequestVersion(r)); err != nil {
 		ctx.Errorf("fail to marshal a response: %s", err.Error())
 		if hij, ok := w.(http.Hijacker); ok {
 			if conn, _, err := hij.Hijack(); err != nil {
@@ -36,3 +43,13 @@ func ServeFetch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
@@ -3,11 +3,19 @@
 package remote
 
 import (
+	"net"
 	"net/http"
+	"time"
 
+	"h12.io/egress/mux"
 	"h12.io/egress/protocol"
 )
 
+const (
+	dialTimeout  = 10 * time.Second
+	muxKeepAlive = 30 * time.Second
+)
+
 func ServeConnect(w http.ResponseWriter, r *http.Request) {
 	ctx := NewContext(r)
 	host := r.Header.Get("Connect-Host")
@@ -15,7 +23,71 @@ func ServeConnect(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if err := protocol.Connect(w, host); err != nil {
+	addr, err := DefaultPolicy.Resolve(host)
+	if err != nil {
+		ctx.Errorf("fail to connect to %s: %v", host, err)
+		if err == ErrDenied {
+			w.WriteHeader(http.StatusForbidden)
+		} else {
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}
+		return
+	}
+	if err := protocol.Connect(w, addr); err != nil {
+		ctx.Errorf("%v", err)
+	}
+}
+
+// ServeMultiplex serves many CONNECT tunnels over one hijacked connection.
+func ServeMultiplex(w http.ResponseWriter, r *http.Request) {
+	ctx := NewContext(r)
+	cli, err := protocol.Hijack(w)
+	if err != nil {
+		ctx.Errorf("%v", err)
+		return
+	}
+	defer cli.Close()
+	if err := protocol.OK200(cli); err != nil {
+		ctx.Errorf("%v", err)
+		return
+	}
+	session := mux.Server(cli, muxKeepAlive)
+	defer session.Close()
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			ctx.Infof("multiplexed connection closed: %v", err)
+			return
+		}
+		go serveStream(ctx, stream)
+	}
+}
+
+func serveStream(ctx *Context, stream *mux.Stream) {
+	defer stream.Close()
+	host := stream.Target()
+	addr, err := DefaultPolicy.Resolve(host)
+	if err != nil {
+		ctx.Errorf("fail to connect to %s: %v", host, err)
+		if err == ErrDenied {
+			stream.Reject(http.StatusForbidden, err.Error())
+		} else {
+			stream.Reject(http.StatusGatewayTimeout, err.Error())
+		}
+		return
+	}
+	srv, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		ctx.Errorf("fail to connect to %s: %v", host, err)
+		stream.Reject(http.StatusGatewayTimeout, err.Error())
+		return
+	}
+	defer srv.Close()
+	if err := stream.Accept(); err != nil {
+		ctx.Errorf("%v", err)
+		return
+	}
+	if err := protocol.Bind(stream, srv); err != nil {
 		ctx.Errorf("%v", err)
 	}
 }
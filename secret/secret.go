@@ -0,0 +1,313 @@
+// Package secret implements an authenticated stream codec with a pre-shared
+// key, suitable for protocol.NewWriter and protocol.NewReader.
+//
+// A stream starts with a random salt, from which a per-stream AES-256-GCM key
+// is derived. The payload follows as sealed chunks, each prefixed with its
+// length. The nonce is a chunk counter plus a final flag, so reordered,
+// dropped or truncated chunks fail to open.
+package secret // import "h12.io/egress/secret"
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"h12.io/errors"
+)
+
+const (
+	saltSize  = 32
+	chunkSize = 16 * 1024
+	lenSize   = 4
+)
+
+var (
+	ErrNoKey     = errors.New("secret: key is not set")
+	ErrAuth      = errors.New("secret: message authentication failed")
+	ErrMalformed = errors.New("secret: malformed stream")
+)
+
+// KeySize is the size of the pre-shared key.
+const KeySize = 32
+
+// Key is the pre-shared key, random bytes rather than a passphrase, so that
+// it cannot be guessed from a captured stream.
+type Key [KeySize]byte
+
+var (
+	key   []byte
+	keyMu sync.RWMutex
+)
+
+// SetKey sets the pre-shared key.
+func SetKey(k *Key) {
+	keyMu.Lock()
+	key = append([]byte(nil), k[:]...)
+	keyMu.Unlock()
+}
+
+// LoadKey reads the pre-shared key from a file and sets it.
+func LoadKey(file string) error {
+	k, err := ReadKey(file)
+	if err != nil {
+		return err
+	}
+	SetKey(k)
+	return nil
+}
+
+// ReadKey reads the pre-shared key from a file without setting it. The file
+// holds the key in hex, e.g. generated by "openssl rand -hex 32".
+func ReadKey(file string) (*Key, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	k, err := ParseKey(buf)
+	if err != nil {
+		return nil, errors.Format("%s: %s", file, err.Error())
+	}
+	return k, nil
+}
+
+// ParseKey parses a key in hex.
+func ParseKey(text []byte) (*Key, error) {
+	var k Key
+	text = bytes.TrimSpace(text)
+	if hex.DecodedLen(len(text)) != KeySize {
+		return nil, errors.Format("secret: expect a key of %d random bytes in hex, got %d characters", KeySize, len(text))
+	}
+	if _, err := hex.Decode(k[:], text); err != nil {
+		return nil, errors.Format("secret: invalid key: %s", err.Error())
+	}
+	return &k, nil
+}
+
+func getKey() []byte {
+	keyMu.RLock()
+	defer keyMu.RUnlock()
+	return key
+}
+
+func newAEAD(salt []byte) (cipher.AEAD, error) {
+	k := getKey()
+	if k == nil {
+		return nil, ErrNoKey
+	}
+	mac := hmac.New(sha256.New, k)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, errors.Wrap(err)
+}
+
+type nonce [12]byte
+
+func (n *nonce) next(final bool) []byte {
+	ret := *n
+	if final {
+		ret[len(ret)-1] = 1
+	}
+	for i := len(n) - 2; i >= 0; i-- {
+		n[i]++
+		if n[i] != 0 {
+			break
+		}
+	}
+	return ret[:]
+}
+
+type writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	nonce  nonce
+	buf    []byte
+	err    error
+	closed bool
+}
+
+func NewWriter(w io.Writer) io.WriteCloser {
+	return &writer{w: w, buf: make([]byte, 0, chunkSize)}
+}
+
+func (w *writer) init() error {
+	if w.aead != nil || w.err != nil {
+		return w.err
+	}
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		w.err = errors.Wrap(err)
+		return w.err
+	}
+	aead, err := newAEAD(salt)
+	if err != nil {
+		w.err = err
+		return err
+	}
+	if _, err := w.w.Write(salt); err != nil {
+		w.err = errors.Wrap(err)
+		return w.err
+	}
+	w.aead = aead
+	return nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("secret: write to closed writer")
+	}
+	if err := w.init(); err != nil {
+		return 0, err
+	}
+	n := 0
+	for len(p) > 0 {
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		n += m
+		if len(w.buf) == cap(w.buf) && len(p) > 0 {
+			if err := w.seal(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush seals and writes the buffered data as a non-final chunk.
+func (w *writer) Flush() error {
+	if err := w.init(); err != nil {
+		return err
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+	return w.seal(false)
+}
+
+func (w *writer) seal(final bool) error {
+	out := make([]byte, lenSize, lenSize+len(w.buf)+w.aead.Overhead())
+	out = w.aead.Seal(out, w.nonce.next(final), w.buf, nil)
+	binary.BigEndian.PutUint32(out, uint32(len(out)-lenSize))
+	w.buf = w.buf[:0]
+	if _, err := w.w.Write(out); err != nil {
+		w.err = errors.Wrap(err)
+		return w.err
+	}
+	return nil
+}
+
+// Close writes the final chunk. It does not close the underlying writer.
+func (w *writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	if err := w.init(); err != nil {
+		w.closed = true
+		return err
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+type reader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	nonce nonce
+	buf   []byte
+	out   []byte
+	plain []byte
+	err   error
+}
+
+func NewReader(r io.Reader) io.ReadCloser {
+	return &reader{r: r}
+}
+
+func (r *reader) init() error {
+	if r.aead != nil || r.err != nil {
+		return r.err
+	}
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(r.r, salt); err != nil {
+		r.err = unexpected(err)
+		return r.err
+	}
+	aead, err := newAEAD(salt)
+	if err != nil {
+		r.err = err
+		return err
+	}
+	r.aead = aead
+	return nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if err := r.init(); err != nil {
+			return 0, err
+		}
+		r.err = r.open()
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *reader) open() error {
+	var lenBuf [lenSize]byte
+	if _, err := io.ReadFull(r.r, lenBuf[:]); err != nil {
+		return unexpected(err)
+	}
+	size := int(binary.BigEndian.Uint32(lenBuf[:]))
+	if size < r.aead.Overhead() || size > chunkSize+r.aead.Overhead() {
+		return ErrMalformed
+	}
+	if cap(r.buf) < size {
+		r.buf = make([]byte, size)
+	}
+	r.buf = r.buf[:size]
+	if _, err := io.ReadFull(r.r, r.buf); err != nil {
+		return unexpected(err)
+	}
+	// try a non-final chunk first, then the final one with the same counter.
+	// Open clobbers its destination on failure, so do not decrypt in place.
+	n := r.nonce
+	plain, err := r.aead.Open(r.out[:0], r.nonce.next(false), r.buf, nil)
+	if err == nil {
+		r.out, r.plain = plain, plain
+		return nil
+	}
+	plain, err = r.aead.Open(r.out[:0], n.next(true), r.buf, nil)
+	if err != nil {
+		return ErrAuth
+	}
+	r.out, r.plain = plain, plain
+	return io.EOF
+}
+
+// Close does not close the underlying reader.
+func (r *reader) Close() error {
+	return nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return errors.Wrap(err)
+}
@@ -0,0 +1,116 @@
+package secret_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"h12.io/egress/protocol"
+	"h12.io/egress/secret"
+)
+
+var testKey, _ = secret.ParseKey([]byte(strings.Repeat("5e", secret.KeySize)))
+
+func init() {
+	secret.SetKey(testKey)
+}
+
+func seal(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := secret.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func open(data []byte) ([]byte, error) {
+	return ioutil.ReadAll(secret.NewReader(bytes.NewReader(data)))
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, 16*1024 - 1, 16 * 1024, 16*1024 + 1, 100000} {
+		data := make([]byte, size)
+		rand.Read(data)
+		sealed := seal(t, data)
+		if size >= 16 && bytes.Contains(sealed, data) {
+			t.Fatalf("size %d: plain text leaked", size)
+		}
+		got, err := open(sealed)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("size %d: mismatch", size)
+		}
+	}
+}
+
+func TestTamper(t *testing.T) {
+	data := make([]byte, 40000)
+	rand.Read(data)
+	sealed := seal(t, data)
+	for _, i := range []int{0, 31, 32, 35, 36, 100, len(sealed) - 1} {
+		tampered := append([]byte(nil), sealed...)
+		tampered[i] ^= 1
+		if _, err := open(tampered); err == nil {
+			t.Fatalf("tampering byte %d is not detected", i)
+		}
+	}
+	for _, n := range []int{0, 10, 32, 100, len(sealed) - 1} {
+		if _, err := open(sealed[:n]); err == nil {
+			t.Fatalf("truncating to %d bytes is not detected", n)
+		}
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	sealed := seal(t, []byte("hello"))
+	var another secret.Key
+	rand.Read(another[:])
+	secret.SetKey(&another)
+	defer secret.SetKey(testKey)
+	if _, err := open(sealed); err != secret.ErrAuth {
+		t.Fatalf("expect %v, got %v", secret.ErrAuth, err)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	k, err := secret.ParseKey([]byte(strings.Repeat("5E", secret.KeySize) + "\n"))
+	if err != nil || *k != *testKey {
+		t.Fatalf("expect the key parsed, got %v", err)
+	}
+	for _, text := range []string{
+		"correct horse battery staple",
+		strings.Repeat("5e", secret.KeySize-1),
+		strings.Repeat("5g", secret.KeySize),
+	} {
+		if _, err := secret.ParseKey([]byte(text)); err == nil {
+			t.Fatalf("expect error of key %q", text)
+		}
+	}
+}
+
+func TestProtocolRequest(t *testing.T) {
+	protocol.NewWriter = secret.NewWriter
+	protocol.NewReader = secret.NewReader
+	req, _ := http.NewRequest("POST", "http://example.com/path?q=1", strings.NewReader("body"))
+	marshaled, err := protocol.MarshalRequest(req, "http://remote/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshaled, err := protocol.UnmarshalRequest(marshaled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(unmarshaled.Body)
+	if unmarshaled.URL.String() != "http://example.com/path?q=1" || string(body) != "body" {
+		t.Fatalf("mismatch: %v %q", unmarshaled.URL, body)
+	}
+}